@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	cmap "github.com/orcaman/concurrent-map"
+)
+
+const (
+	compressNone = ""
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+
+	// zstdMarkerMagic starts the skippable frame written before the zstd
+	// stream; its JSON payload (compressMeta) keeps the original file name.
+	// Other zstd decoders skip it.
+	zstdMarkerMagic = 0x184D2A5C
+	markerComment   = "cowtransfer-uploader"
+	maxMarkerSize   = 64 * 1024
+)
+
+type compressMeta struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+func compressExt(kind string) string {
+	switch kind {
+	case compressGzip:
+		return ".gz"
+	case compressZstd:
+		return ".zst"
+	}
+	return ""
+}
+
+func compressKind(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		return compressGzip
+	case strings.HasSuffix(name, ".zst"):
+		return compressZstd
+	}
+	return compressNone
+}
+
+func setupCompress() error {
+	switch runConfig.compress {
+	case compressNone, compressGzip, compressZstd:
+	default:
+		return fmt.Errorf("unknown compression: %s (zstd|gzip)", runConfig.compress)
+	}
+	if runConfig.compress != compressNone && splitBytes > 0 {
+		return fmt.Errorf("--compress can not be combined with --split-size")
+	}
+	return nil
+}
+
+// compressTo writes src to w compressed with --compress. The original name
+// is kept in the gzip header or in a leading zstd skippable frame.
+func compressTo(w io.Writer, src io.Reader, info os.FileInfo) error {
+	var enc io.WriteCloser
+	switch runConfig.compress {
+	case compressGzip:
+		zw := gzip.NewWriter(w)
+		zw.Header = gzip.Header{Name: info.Name(), ModTime: info.ModTime(), Comment: markerComment}
+		enc = zw
+	case compressZstd:
+		meta, err := json.Marshal(compressMeta{Name: info.Name(), Size: info.Size()})
+		if err != nil {
+			return err
+		}
+		var head [8]byte
+		binary.LittleEndian.PutUint32(head[:4], zstdMarkerMagic)
+		binary.LittleEndian.PutUint32(head[4:], uint32(len(meta)))
+		if _, err := w.Write(append(head[:], meta...)); err != nil {
+			return err
+		}
+		if enc, err = zstd.NewWriter(w); err != nil {
+			return err
+		}
+	}
+	if _, err := io.Copy(enc, src); err != nil {
+		_ = enc.Close()
+		return err
+	}
+	return enc.Close()
+}
+
+// decompressFrom returns the decompressed content of r and the original
+// file name stored by compressTo, or "" for streams from other tools.
+func decompressFrom(kind string, r io.Reader) (io.ReadCloser, string, error) {
+	if kind == compressGzip {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, "", err
+		}
+		return zr, zr.Name, nil
+	}
+	br := bufio.NewReader(r)
+	name := ""
+	if head, err := br.Peek(8); err == nil && binary.LittleEndian.Uint32(head[:4]) == zstdMarkerMagic {
+		size := int(binary.LittleEndian.Uint32(head[4:]))
+		if size <= maxMarkerSize {
+			data := make([]byte, 8+size)
+			if _, err := io.ReadFull(br, data); err != nil {
+				return nil, "", err
+			}
+			var meta compressMeta
+			if json.Unmarshal(data[8:], &meta) == nil {
+				name = meta.Name
+			}
+		}
+	}
+	zr, err := zstd.NewReader(br)
+	if err != nil {
+		return nil, "", err
+	}
+	return zr.IOReadCloser(), name, nil
+}
+
+// uploadCompressed compresses file into the part pipeline as it is read and
+// returns the MD5 of the uncompressed content for the history.
+func uploadCompressed(l *logger, file io.ReaderAt, info os.FileInfo, baseConf *prepareSendResp) (string, error) {
+	name := info.Name() + compressExt(runConfig.compress)
+	fmt.Printf("Compress: %s (%s)\n", name, runConfig.compress)
+	var src io.Reader = io.NewSectionReader(file, 0, info.Size())
+	bar := progress.start(name, info.Size())
+	if bar != nil {
+		src = bar.NewProxyReader(src)
+	}
+	sum := md5.New()
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(compressTo(pw, io.TeeReader(src, sum), info))
+	}()
+	size, err := uploadStream(l, pr, volumeInfo{name, info.Size()}, baseConf)
+	_ = pr.CloseWithError(err)
+	progress.finish(bar)
+	if err != nil {
+		return "", err
+	}
+	l.Debug("compressed upload finished", "size", info.Size(), "compressed", size)
+	fmt.Printf("Compressed %s to %s\n", humanBytes(info.Size()), humanBytes(size))
+	return hexSum(sum), nil
+}
+
+// uploadStream uploads r, whose size is not known up front, by reading one
+// block at a time into memory, so retries do not need to re-read r. At most
+// workerCount()+1 block buffers are in use at once. It returns the number of
+// bytes sent.
+func uploadStream(l *logger, r io.Reader, info os.FileInfo, baseConf *prepareSendResp) (int64, error) {
+	// the stream size is only known at the end, the file is announced with
+	// an unknown (zero) size; info.Size() only sizes the blocks.
+	config, err := getUploadConfig(l, volumeInfo{info.Name(), 0}, baseConf)
+	if err != nil {
+		return 0, fmt.Errorf("getUploadConfig returns error: %w", err)
+	}
+	wg := new(sync.WaitGroup)
+	ch := make(chan *uploadPart)
+	hashMap := cmap.New()
+	failed := new(firstError)
+	tune := newTuner()
+	defer tune.close()
+	for i := 0; i < workerCount(); i++ {
+		go uploader(&ch, uploadConfig{
+			wg:      wg,
+			config:  config,
+			hashMap: &hashMap,
+			tuner:   tune,
+			log:     l,
+			failed:  failed,
+		})
+	}
+	part, total := int64(0), int64(0)
+	block := blockSizeFor(info.Size())
+	free := make(chan []byte, workerCount()+1)
+	allocated := 0
+	l.Debug("stream upload started", "block", block, "workers", workerCount())
+	for failed.get() == nil {
+		var buf []byte
+		select {
+		case buf = <-free:
+		default:
+			if allocated < cap(free) {
+				buf = make([]byte, block)
+				allocated++
+			} else {
+				buf = <-free
+			}
+		}
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			if part == maxParts {
+				err = errorf(kindQuota, "compressed stream needs more than %d parts", maxParts)
+				break
+			}
+			part++
+			total += int64(n)
+			wg.Add(1)
+			ch <- &uploadPart{data: buf[:n], size: int64(n), count: part, release: func() { free <- buf }}
+		} else {
+			free <- buf
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			err = fmt.Errorf("read upload stream returns error: %w", rerr)
+			break
+		}
+	}
+	wg.Wait()
+	close(ch)
+	if err != nil {
+		return 0, err
+	}
+	if err = failed.get(); err != nil {
+		return 0, err
+	}
+	if err = finishUpload(l, config, info, &hashMap, part); err != nil {
+		return 0, fmt.Errorf("finishUpload returns error: %w", err)
+	}
+	return total, nil
+}
+
+// downloadDecompress saves a compressed item decompressed, under the name
+// recorded when it was uploaded (or without the compression extension).
+func downloadDecompress(item downloadDetailsBlock, link, kind string) error {
+	numSize, err := strconv.ParseFloat(item.Size, 10)
+	if err != nil {
+		return fmt.Errorf("failed Parsing with error: %s, onfile: %s", err, item.FileName)
+	}
+	bar := progress.start(item.FileName, int64(numSize*1024))
+	defer progress.finish(bar)
+
+	pr, pw := io.Pipe()
+	errCh := make(chan error, 1)
+	go func() {
+		err := streamFile(pw, link, bar)
+		_ = pw.CloseWithError(err)
+		errCh <- err
+	}()
+	err = decompressItem(pr, item, kind)
+	_ = pr.CloseWithError(err)
+	if dlErr := <-errCh; dlErr != nil && (err == nil || err == io.ErrClosedPipe) {
+		err = dlErr
+	}
+	if err != nil {
+		return fmt.Errorf("decompress returns error: %w, onfile: %s", err, item.FileName)
+	}
+	return nil
+}
+
+func decompressItem(r io.Reader, item downloadDetailsBlock, kind string) error {
+	zr, name, err := decompressFrom(kind, r)
+	if err != nil {
+		return wrapError(kindIntegrity, err)
+	}
+	defer func() {
+		_ = zr.Close()
+	}()
+	if isStdout(runConfig.prefix) {
+		_, err = io.Copy(stdout, zr)
+		return err
+	}
+	if name == "" || name != filepath.Base(name) {
+		name = strings.TrimSuffix(item.FileName, filepath.Ext(item.FileName))
+	}
+	path := runConfig.prefix
+	if isExist(path) && !isFile(path) {
+		if path, err = safeJoin(runConfig.prefix, name); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("File save to: %s\n", path)
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, zr)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// a closed pipe means the download failed, which the caller
+		// reports instead; the partial file goes either way.
+		_ = os.Remove(path)
+		if err == io.ErrClosedPipe {
+			return err
+		}
+		return wrapError(kindIntegrity, err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	for _, kind := range []string{compressZstd, compressGzip} {
+		t.Run(kind, func(t *testing.T) {
+			fake, _ := withFakeCowtransfer(t)
+			runConfig.blockSize = 64 * 1024
+			runConfig.parallel = 3
+
+			// half noise, half text, so that the compressed stream still
+			// spans several parts.
+			content := make([]byte, 512*1024)
+			rand.New(rand.NewSource(1)).Read(content[:256*1024])
+			copy(content[256*1024:], strings.Repeat("cowtransfer ", 256*1024/12))
+			path := filepath.Join(t.TempDir(), "data.bin")
+			if err := os.WriteFile(path, content, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			runConfig.compress = kind
+			if err := upload([]string{path}); err != nil {
+				t.Fatalf("upload: %v", err)
+			}
+			name := "data.bin" + compressExt(kind)
+			if len(fake.names) != 1 || fake.names[0] != name {
+				t.Fatalf("uploaded %q, want %q", fake.names, name)
+			}
+			if fake.parts < 2 || !fake.merged {
+				t.Fatalf("parts = %d, merged = %v", fake.parts, fake.merged)
+			}
+			if len(fake.announced) != 1 || fake.announced[0] != "0" {
+				t.Fatalf("announced size %q, want the unknown size 0", fake.announced)
+			}
+
+			runConfig.compress = compressNone
+			runConfig.decompress = true
+			runConfig.prefix = t.TempDir()
+			if err := download("https://cowtransfer.com/s/" + fakeShareID); err != nil {
+				t.Fatalf("download: %v", err)
+			}
+			got, err := os.ReadFile(filepath.Join(runConfig.prefix, "data.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Fatalf("round trip changed the content (%d of %d bytes)", len(got), len(content))
+			}
+		})
+	}
+}
+
+// failingReader returns data and then err.
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestDecompressItemRemovesPartialFile(t *testing.T) {
+	saved := *runConfig
+	defer func() { *runConfig = saved }()
+	runConfig.compress = compressGzip
+	runConfig.prefix = t.TempDir()
+
+	var full bytes.Buffer
+	info := volumeInfo{"data.bin", 0}
+	if err := compressTo(&full, strings.NewReader(strings.Repeat("cowtransfer ", 100000)), info); err != nil {
+		t.Fatal(err)
+	}
+	half := full.Bytes()[:full.Len()/2]
+
+	for _, err := range []error{io.ErrClosedPipe, io.ErrUnexpectedEOF} {
+		r := &failingReader{data: append([]byte{}, half...), err: err}
+		got := decompressItem(r, downloadDetailsBlock{FileName: "data.bin.gz"}, compressGzip)
+		if got == nil {
+			t.Fatalf("%v: expected an error", err)
+		}
+		if _, serr := os.Stat(filepath.Join(runConfig.prefix, "data.bin")); !os.IsNotExist(serr) {
+			t.Fatalf("%v: partial output left behind (%v)", err, serr)
+		}
+	}
+}
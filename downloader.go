@@ -5,10 +5,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"path"
 	"regexp"
 	"strconv"
 	"sync"
@@ -18,18 +17,20 @@ import (
 )
 
 const (
-	downloadDetails = "https://cowtransfer.com/api/transfer/transferdetail?url=%s&treceive=undefined&passcode=%s"
-	downloadFiles   = "https://cowtransfer.com/api/transfer/files?page=%d&guid=%s"
-	downloadConfig  = "https://cowtransfer.com/api/transfer/download?guid=%s"
+	downloadDetails = "/api/transfer/transferdetail?url=%s&treceive=undefined&passcode=%s"
+	downloadFiles   = "/api/transfer/files?page=%d&guid=%s"
+	downloadConfig  = "/api/transfer/download?guid=%s"
+	downloadByCode  = "/api/transfer/v2/transferbytempcode?code=%s"
 )
 
-var regex = regexp.MustCompile("[0-9a-f]{14}")
+var codeRegex = regexp.MustCompile("^[0-9]{6}$")
 
 type downloadDetailsResponse struct {
 	GUID         string `json:"guid"`
 	DownloadName string `json:"downloadName"`
 	Deleted      bool   `json:"deleted"`
 	Uploaded     bool   `json:"uploaded"`
+	NeedPassword bool   `json:"needPassword"`
 	// Details      []downloadDetailsBlock `json:"transferFileDtos"`
 }
 
@@ -48,39 +49,86 @@ type downloadConfigResponse struct {
 	Link string `json:"link"`
 }
 
-func download(v string) error {
-	fileID := regex.FindString(v)
-	if fileID == "" {
-		return fmt.Errorf("unknown URL format")
-	}
+type downloadCodeResponse struct {
+	UniqueURL    string `json:"uniqueUrl"`
+	Error        bool   `json:"error"`
+	ErrorMessage string `json:"error_message"`
+}
 
-	if runConfig.debugMode {
-		log.Println("starting download...")
-		log.Println("step1 -> api/getGuid")
-	}
-	fmt.Printf("Remote: %s\n", v)
+func isDownloadCode(v string) bool {
+	return codeRegex.MatchString(v) && !isExist(v)
+}
 
-	body, err := fetchWithCookie(fmt.Sprintf(downloadDetails, fileID, runConfig.passCode), fileID)
+func downloadCode(code string) error {
+	logs.Debug("step0 -> api/resolveCode", "code", code)
+	fmt.Printf("Short Download Code: %s\n", code)
+	body, err := fetchWithCookie(fmt.Sprintf(apiBase+downloadByCode, code), "")
+	if err != nil {
+		return err
+	}
+	logs.Debug("resolve code returns", "body", body)
+	resp := new(downloadCodeResponse)
+	if err := json.Unmarshal(body, resp); err != nil {
+		return fmt.Errorf("unmatshal DownloadCode returns error: %s", err)
+	}
+	if resp.Error {
+		return apiError("resolve download code failed: " + resp.ErrorMessage)
+	}
+	if resp.UniqueURL == "" {
+		return errorf(kindUsage, "download code invalid or expired")
+	}
+	return download(resp.UniqueURL)
+}
 
-	if runConfig.debugMode {
-		log.Printf("returns: %v\n", string(body))
+func download(v string) error {
+	link, err := parseShareLink(v)
+	if err != nil {
+		return wrapError(kindUsage, err)
+	}
+	fileID := link.ID
+	passCode := runConfig.passCode
+	if passCode == "" {
+		passCode = link.Password
+	}
+	if passCode == "" {
+		if passCode, err = presetPassword(); err != nil {
+			return err
+		}
 	}
 
-	details := new(downloadDetailsResponse)
-	if err := json.Unmarshal(body, details); err != nil {
-		return fmt.Errorf("unmatshal DownloadDetails returns error: %s", err)
+	logs.Debug("step1 -> api/getGuid", "id", fileID)
+	fmt.Printf("Remote: %s\n", v)
+
+	var details *downloadDetailsResponse
+	for attempt := 0; ; attempt++ {
+		details, err = fetchDetails(fileID, passCode)
+		if err != nil {
+			return err
+		}
+		if !details.NeedPassword || details.GUID != "" {
+			break
+		}
+		if passCode != "" {
+			fmt.Printf("Password incorrect\n")
+		}
+		if attempt >= 3 || !canPromptPassword() {
+			return errorf(kindAuth, "link is password protected, use --password, $%s or --password-fd", passwordEnv)
+		}
+		if passCode, err = promptPassword(fileID); err != nil {
+			return err
+		}
 	}
 
 	if details.GUID == "" {
-		return fmt.Errorf("link invalid")
+		return errorf(kindUsage, "link invalid")
 	}
 
 	if details.Deleted {
-		return fmt.Errorf("link deleted")
+		return errorf(kindDeleted, "link deleted")
 	}
 
 	if !details.Uploaded {
-		return fmt.Errorf("link not finish upload yet")
+		return errorf(kindNotUploaded, "link not finish upload yet")
 	}
 
 	files, err := fetchPage(0, details.GUID, fileID)
@@ -98,25 +146,54 @@ func download(v string) error {
 		}
 	}
 
+	if runConfig.dryRun {
+		return dryRunDownload(files.Details)
+	}
+
+	if isStdout(runConfig.prefix) && len(files.Details) != 1 {
+		return errorf(kindUsage, "streaming to stdout needs a single-file transfer, got %d files", len(files.Details))
+	}
+
+	for _, item := range files.Details {
+		if numSize, err := strconv.ParseFloat(item.Size, 10); err == nil {
+			progress.expect(int64(numSize * 1024))
+		}
+	}
+	var errs []error
 	for _, item := range files.Details {
 		err = downloadItem(item)
 		if err != nil {
 			fmt.Println(err)
+			errs = append(errs, err)
 		}
 	}
-	return nil
+	errs = append(errs, joinSplitFiles(files.Details)...)
+	return combineErrors(errs, len(files.Details))
 }
 
-func fetchPage(page int, guid string, fileID string) (*downloadFilesResponse, error) {
-	body, err := fetchWithCookie(fmt.Sprintf(downloadFiles, page, guid), fileID)
+func fetchDetails(fileID, passCode string) (*downloadDetailsResponse, error) {
+	body, err := fetchWithCookie(fmt.Sprintf(apiBase+downloadDetails, fileID, url.QueryEscape(passCode)), fileID)
 	if err != nil {
-		return nil, fmt.Errorf("fetch DownloadDetails returns error: %s", err)
+		return nil, err
+	}
+
+	logs.Debug("transfer details returns", "id", fileID, "body", body)
+
+	details := new(downloadDetailsResponse)
+	if err := json.Unmarshal(body, details); err != nil {
+		return nil, fmt.Errorf("unmatshal DownloadDetails returns error: %s", err)
 	}
+	return details, nil
+}
 
-	if runConfig.debugMode {
-		log.Printf("returns: %v\n", string(body))
+func fetchPage(page int, guid string, fileID string) (*downloadFilesResponse, error) {
+	body, err := fetchWithCookie(fmt.Sprintf(apiBase+downloadFiles, page, guid), fileID)
+	if err != nil {
+		return nil, fmt.Errorf("fetch DownloadDetails returns error: %w", err)
 	}
 
+	logs.Debug("transfer files returns", "page", page, "body", body)
+
 	files := new(downloadFilesResponse)
 	if err := json.Unmarshal(body, files); err != nil {
 		return nil, fmt.Errorf("unmatshal DownloadDetails returns error: %s", err)
@@ -131,9 +208,9 @@ func fetchWithCookie(link, fileID string) ([]byte, error) {
 	}
 	req.Header.Set("Referer", fmt.Sprintf("https://cowtransfer.com/s/%s", fileID))
 	req.Header.Set("Cookie", fmt.Sprintf("cf-cs-k-20181214=%d;", time.Now().UnixNano()))
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := apiClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("getDownloadDetails returns error: %s", err)
+		return nil, errorf(kindNetwork, "getDownloadDetails returns error: %s", err)
 	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -145,20 +222,16 @@ func fetchWithCookie(link, fileID string) ([]byte, error) {
 }
 
 func downloadItem(item downloadDetailsBlock) error {
-	if runConfig.debugMode {
-		log.Println("step2 -> api/getConf")
-		log.Printf("fileName: %s\n", item.FileName)
-		log.Printf("fileSize: %s\n", item.Size)
-		log.Printf("GUID: %s\n", item.GUID)
-	}
-	configURL := fmt.Sprintf(downloadConfig, item.GUID)
+	l := logs.With("file", item.FileName, "guid", item.GUID)
+	l.Debug("step2 -> api/getConf", "size", item.Size)
+	configURL := fmt.Sprintf(apiBase+downloadConfig, item.GUID)
 	req, err := http.NewRequest("POST", configURL, nil)
 	if err != nil {
 		return fmt.Errorf("createRequest returns error: %s, onfile: %s", err, item.FileName)
 	}
-	resp, err := http.DefaultClient.Do(addHeaders(req))
+	resp, err := apiClient.Do(addHeaders(req))
 	if err != nil {
-		return fmt.Errorf("getDownloadConfig returns error: %s, onfile: %s", err, item.FileName)
+		return errorf(kindNetwork, "getDownloadConfig returns error: %s, onfile: %s", err, item.FileName)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
@@ -167,25 +240,32 @@ func downloadItem(item downloadDetailsBlock) error {
 	}
 
 	_ = resp.Body.Close()
-	if runConfig.debugMode {
-		log.Printf("returns: %v\n", string(body))
-	}
+	l.Debug("download config returns", "body", body)
 	config := new(downloadConfigResponse)
 	if err := json.Unmarshal(body, config); err != nil {
 		return fmt.Errorf("unmatshal DownloadConfig returns error: %s, onfile: %s", err, item.FileName)
 	}
 
-	if runConfig.debugMode {
-		log.Println("step3 -> startDownload")
+	l.Debug("step3 -> startDownload")
+	if kind := compressKind(item.FileName); runConfig.decompress && kind != compressNone &&
+		!(runConfig.extract && archiveKind(item.FileName) != archiveNone) {
+		return downloadDecompress(item, config.Link, kind)
 	}
-	filePath := runConfig.prefix
-
-	if isExist(runConfig.prefix) {
-		if isFile(runConfig.prefix) {
-			filePath = runConfig.prefix
-		} else {
-			filePath = path.Join(runConfig.prefix, item.FileName)
+	if isStdout(runConfig.prefix) {
+		bar := progress.start(item.FileName, 0)
+		err = streamFile(stdout, config.Link, bar)
+		progress.finish(bar)
+		if err != nil {
+			return fmt.Errorf("failed streaming with error: %w, onfile: %s", err, item.FileName)
 		}
+		return nil
+	}
+	if kind := archiveKind(item.FileName); runConfig.extract && kind != archiveNone {
+		return downloadExtract(item, config.Link, kind)
+	}
+	filePath, err := destinationPath(item)
+	if err != nil {
+		return err
 	}
 
 	fmt.Printf("File save to: %s\n", filePath)
@@ -193,21 +273,24 @@ func downloadItem(item downloadDetailsBlock) error {
 	if err != nil {
 		return fmt.Errorf("failed Parsing with error: %s, onfile: %s", err, item.FileName)
 	}
-	var bar *pb.ProgressBar
-	if !runConfig.silentMode {
-		bar = pb.Full.Start64(int64(numSize * 1024))
-		bar.Set(pb.Bytes, true)
-	}
+	bar := progress.start(item.FileName, int64(numSize*1024))
 	err = downloadFile(filePath, config.Link, bar)
-	if !runConfig.silentMode && bar != nil {
-		bar.Finish()
-	}
+	progress.finish(bar)
 	if err != nil {
-		return fmt.Errorf("failed DownloadConfig with error: %s, onfile: %s", err, item.FileName)
+		return fmt.Errorf("failed DownloadConfig with error: %w, onfile: %s", err, item.FileName)
 	}
 	return nil
 }
 
+// destinationPath returns where item is saved: the prefix itself when it is
+// a file or does not exist yet, otherwise the item name inside the prefix.
+func destinationPath(item downloadDetailsBlock) (string, error) {
+	if isExist(runConfig.prefix) && !isFile(runConfig.prefix) {
+		return safeJoin(runConfig.prefix, item.FileName)
+	}
+	return runConfig.prefix, nil
+}
+
 type writeCounter struct {
 	bar    *pb.ProgressBar
 	offset int64
@@ -226,25 +309,32 @@ func (wc *writeCounter) Write(p []byte) (int, error) {
 	return n, nil
 }
 
-func downloadFile(filepath string, url string, bar *pb.ProgressBar) error {
-
+func probeFile(url string) (int64, bool, error) {
 	req, err := http.NewRequest("HEAD", url, nil)
 	if err != nil {
-		return err
+		return 0, false, err
 	}
 	addHeaders(req)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := doDownload(req)
 	if err != nil {
-		return err
+		return 0, false, wrapError(kindNetwork, err)
 	}
 	defer func() {
 		_ = resp.Body.Close()
 	}()
 
-	if resp.StatusCode > 400 {
-		return fmt.Errorf("link unavailable, %s", resp.Status)
+	if resp.StatusCode >= 400 {
+		return 0, false, statusError(resp)
 	}
 	length, err := strconv.ParseInt(resp.Header.Get("content-length"), 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return length, resp.Header.Get("Accept-Ranges") != "", nil
+}
+
+func downloadFile(filepath string, url string, bar *pb.ProgressBar) error {
+	length, ranged, err := probeFile(url)
 	if err != nil {
 		return err
 	}
@@ -266,67 +356,95 @@ func downloadFile(filepath string, url string, bar *pb.ProgressBar) error {
 	if err := out.Truncate(length); err != nil {
 		return fmt.Errorf("tmpfile fruncate failed: %s", err)
 	}
-	if length > 10*1024*1024 && resp.Header.Get("Accept-Ranges") != "" && runConfig.parallel > 1 || runConfig.parallel < 1 {
+	if runConfig.autoMode && ranged {
+		return downloadChunks(out, url, length, bar)
+	}
+	if length > 10*1024*1024 && ranged && runConfig.parallel > 1 || runConfig.parallel < 1 {
 		_parallel = runConfig.parallel
 	}
 
 	wg := new(sync.WaitGroup)
+	failed := new(firstError)
 	blk := length / int64(_parallel)
 
-	if runConfig.debugMode {
-		log.Printf("filesize = %d", length)
-		log.Printf("parallel = %d", _parallel)
-		log.Printf("block = %d", blk)
-	}
+	l := logs.With("path", filepath)
+	l.Debug("download started", "size", length, "parallel", _parallel, "block", blk)
 	for i := 0; i < _parallel; i++ {
 		wg.Add(1)
 		start := int64(i) * blk
 		end := start + blk
-		ranger := fmt.Sprintf("%d-%d", start, end)
 		if end >= length || i == _parallel-1 {
-			ranger = fmt.Sprintf("%d-%d", start, length)
-		}
-		if runConfig.debugMode {
-			log.Printf("downloading parallel = %d\n", i)
-			log.Printf("selecting block = %d\n", blk)
-			log.Printf("using range = %s\n", ranger)
+			end = length
 		}
+		l.Debug("range worker started", "worker", i, "start", start, "end", end)
 		go func() {
+			defer wg.Done()
 			counter := &writeCounter{bar: bar, offset: start, writer: out}
-			for {
-				err = parallelDownloader(ranger, url, counter, wg)
+			// failures counts attempts in a row that made no progress; a
+			// range that stalls resumes from what was already written.
+			failures := 0
+			for counter.offset < end && failed.get() == nil {
+				offset := counter.offset
+				err := parallelDownloader(url, counter, start == 0 && end == length, end)
 				if err == nil {
 					break
 				}
+				if counter.offset > offset {
+					failures = 0
+				}
+				failures++
+				if !retryable(err) || failures >= maxRetries {
+					l.Warn("range failed", "start", offset, "end", end, "error", err)
+					failed.set(wrapError(kindNetwork, fmt.Errorf("range %d-%d returns error: %w", offset, end-1, err)))
+					return
+				}
+				l.Debug("range failed (retrying)", "start", offset, "end", end, "error", err)
+				progress.retry(bar)
+				time.Sleep(retryDelay(failures))
 			}
 		}()
 	}
 	wg.Wait()
-
-	fmt.Print("\n")
-	return nil
+	return failed.get()
 }
 
-func parallelDownloader(ranger string, url string, counter *writeCounter, wg *sync.WaitGroup) error {
+// parallelDownloader fetches [counter.offset, end) into counter. whole is
+// set when the range covers the entire file, in which case a server that
+// ignores Range and answers 200 is accepted as well.
+func parallelDownloader(url string, counter *writeCounter, whole bool, end int64) error {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return fmt.Errorf("createRequest error: %s\n", err)
+		return fmt.Errorf("createRequest error: %s", err)
 	}
-	req.Header.Set("Range", "bytes="+ranger)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", counter.offset, end-1))
 	addHeaders(req)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := doDownload(req)
 	if err != nil {
-		return fmt.Errorf("doRequest error: %s\n", err)
+		return wrapError(kindNetwork, fmt.Errorf("doRequest error: %w", err))
 	}
 	defer func() {
 		_ = resp.Body.Close()
 	}()
 
-	_, err = io.Copy(ioutil.Discard, io.TeeReader(resp.Body, counter))
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK && whole:
+		// the body starts at zero, drop what an earlier attempt wrote.
+		if !runConfig.silentMode && counter.bar != nil {
+			counter.bar.Add64(-counter.offset)
+		}
+		counter.offset = 0
+	default:
+		return statusError(resp)
+	}
+
+	_, err = io.Copy(counter, io.LimitReader(resp.Body, end-counter.offset))
 	if err != nil {
-		return fmt.Errorf("parallel bytes copy returns: %s", err)
+		return wrapError(kindNetwork, fmt.Errorf("parallel bytes copy returns: %w", err))
+	}
+	if counter.offset < end {
+		return errorf(kindNetwork, "short range read: %d of %d bytes", counter.offset, end)
 	}
-	wg.Done()
 	return nil
 }
 
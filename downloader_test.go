@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func rangeServer(t *testing.T, content []byte, get func(w http.ResponseWriter, r *http.Request) bool) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			return
+		}
+		if get != nil && get(w, r) {
+			return
+		}
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDownloadFileRanges(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1024*1024)
+	srv := rangeServer(t, content, nil)
+
+	path := filepath.Join(t.TempDir(), "out")
+	if err := downloadFile(path, srv.URL, nil); err != nil {
+		t.Fatalf("downloadFile: %v", err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("downloaded %d bytes, content differs", len(got))
+	}
+}
+
+func TestDownloadFileIgnoredRange(t *testing.T) {
+	content := []byte("a file small enough for a single range worker")
+	srv := rangeServer(t, content, func(w http.ResponseWriter, r *http.Request) bool {
+		_, _ = w.Write(content)
+		return true
+	})
+
+	path := filepath.Join(t.TempDir(), "out")
+	if err := downloadFile(path, srv.URL, nil); err != nil {
+		t.Fatalf("downloadFile: %v", err)
+	}
+	got, _ := ioutil.ReadFile(path)
+	if !bytes.Equal(got, content) {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestDownloadFileStatus(t *testing.T) {
+	cases := []struct {
+		status int
+		kind   errorKind
+	}{
+		{http.StatusForbidden, kindAuth},
+		{http.StatusNotFound, kindDeleted},
+		{http.StatusGone, kindDeleted},
+	}
+	for _, c := range cases {
+		t.Run(strconv.Itoa(c.status), func(t *testing.T) {
+			gets := 0
+			srv := rangeServer(t, []byte("content"), func(w http.ResponseWriter, r *http.Request) bool {
+				gets++
+				w.WriteHeader(c.status)
+				_, _ = fmt.Fprint(w, "error page")
+				return true
+			})
+			err := downloadFile(filepath.Join(t.TempDir(), "out"), srv.URL, nil)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if kindOf(err) != c.kind {
+				t.Fatalf("kind = %d, want %d (%v)", kindOf(err), c.kind, err)
+			}
+			if gets != 1 {
+				t.Fatalf("%d requests, final status must not be retried", gets)
+			}
+		})
+	}
+}
+
+func TestDownloadCode(t *testing.T) {
+	fake, _ := withFakeCowtransfer(t)
+	fake.code = "123456"
+	fake.addFile("code.txt", []byte("resolved by code"))
+
+	runConfig.prefix = t.TempDir()
+	if err := downloadCode("123456"); err != nil {
+		t.Fatalf("downloadCode: %v", err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(runConfig.prefix, "code.txt"))
+	if err != nil || string(got) != "resolved by code" {
+		t.Fatalf("downloaded %q, %v", got, err)
+	}
+
+	if err := downloadCode("654321"); kindOf(err) != kindUsage {
+		t.Fatalf("unknown code: err = %v, want a usage error", err)
+	}
+	if len(fake.lookups) != 2 || fake.lookups[0] != "123456" || fake.lookups[1] != "654321" {
+		t.Fatalf("looked up codes %q", fake.lookups)
+	}
+
+	fake.deleted = true
+	if err := downloadCode("123456"); kindOf(err) != kindDeleted {
+		t.Fatalf("deleted transfer: err = %v, want a deleted error", err)
+	}
+
+	fake.codeError = "请先登录"
+	if err := downloadCode("123456"); kindOf(err) != kindAuth {
+		t.Fatalf("api error: err = %v, want an auth error", err)
+	}
+}
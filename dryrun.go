@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// dryRunUpload walks the inputs with the upload filters and prints the
+// files, sizes and part counts that would be sent, without contacting the
+// API.
+func dryRunUpload(files []string) error {
+	var errs []error
+	total, totalSize, totalParts := 0, int64(0), int64(0)
+	fmt.Printf("Dry run, nothing will be uploaded.\n\n")
+	fmt.Printf("%-14s%-8s%-12s%s\n", "Size", "Parts", "Block", "Path")
+	for _, v := range files {
+		if !isExist(v) {
+			fmt.Printf("%s not found\n", v)
+			total++
+			errs = append(errs, errorf(kindUsage, "%s not found", v))
+			continue
+		}
+		err := walkFiles(v, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				fmt.Printf("filapath walker returns error: %v, onfile: %s\n", err, path)
+				errs = append(errs, err)
+				return nil
+			}
+			total++
+			block := blockSizeFor(info.Size())
+			parts := (info.Size() + block - 1) / block
+			totalSize += info.Size()
+			totalParts += parts
+			if splitBytes > 0 && info.Size() > splitBytes {
+				volumes := (info.Size() + splitBytes - 1) / splitBytes
+				fmt.Printf("%-14d%-8d%-12d%s (%d volumes)\n", info.Size(), parts, block, path, volumes)
+				return nil
+			}
+			fmt.Printf("%-14d%-8d%-12d%s\n", info.Size(), parts, block, path)
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	links := total
+	if runConfig.singleMode {
+		links = 1
+	}
+	fmt.Printf("\n%d file(s), %d bytes (%s), %d part(s), %d link(s)\n",
+		total, totalSize, humanBytes(totalSize), totalParts, links)
+	return combineErrors(errs, total)
+}
+
+// dryRunDownload prints the resolved file list and destination paths.
+func dryRunDownload(items []downloadDetailsBlock) error {
+	fmt.Printf("Dry run, nothing will be downloaded.\n\n")
+	fmt.Printf("%-14s%-40s%s\n", "Size", "Name", "Destination")
+	var errs []error
+	totalSize := int64(0)
+	for _, item := range items {
+		numSize, _ := strconv.ParseFloat(item.Size, 10)
+		size := int64(numSize * 1024)
+		totalSize += size
+		dest := ""
+		switch {
+		case isStdout(runConfig.prefix):
+			dest = "<stdout>"
+		case runConfig.extract && archiveKind(item.FileName) != archiveNone:
+			dest = runConfig.prefix + " (extract)"
+		default:
+			var err error
+			if dest, err = destinationPath(item); err != nil {
+				dest = "<skipped: " + err.Error() + ">"
+				errs = append(errs, err)
+			}
+		}
+		fmt.Printf("%-14d%-40s%s\n", size, item.FileName, dest)
+	}
+	fmt.Printf("\n%d file(s), about %d bytes (%s)\n", len(items), totalSize, humanBytes(totalSize))
+	return combineErrors(errs, len(items))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type errorKind int
+
+// Exit codes, also listed in printUsage and the README.
+const (
+	kindGeneral     errorKind = 1
+	kindUsage       errorKind = 2
+	kindAuth        errorKind = 3
+	kindDeleted     errorKind = 4
+	kindNotUploaded errorKind = 5
+	kindQuota       errorKind = 6
+	kindNetwork     errorKind = 7
+	kindIntegrity   errorKind = 8
+	kindPartial     errorKind = 9
+)
+
+var exitCodes = []struct {
+	kind errorKind
+	desc string
+}{
+	{kindGeneral, "general error"},
+	{kindUsage, "invalid arguments, flags or link"},
+	{kindAuth, "authentication failed or password required/incorrect"},
+	{kindDeleted, "link deleted"},
+	{kindNotUploaded, "link not finish upload yet"},
+	{kindQuota, "quota or size limit exceeded"},
+	{kindNetwork, "network error"},
+	{kindIntegrity, "integrity check failed"},
+	{kindPartial, "some, but not all, files failed"},
+}
+
+type transferError struct {
+	Kind errorKind
+	Err  error
+}
+
+func (e *transferError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *transferError) Unwrap() error {
+	return e.Err
+}
+
+func errorf(kind errorKind, format string, a ...interface{}) error {
+	return &transferError{Kind: kind, Err: fmt.Errorf(format, a...)}
+}
+
+// wrapError tags err with kind, keeping a more specific kind if err already
+// carries one.
+func wrapError(kind errorKind, err error) error {
+	if err == nil {
+		return nil
+	}
+	var te *transferError
+	if errors.As(err, &te) {
+		return err
+	}
+	return &transferError{Kind: kind, Err: err}
+}
+
+func kindOf(err error) errorKind {
+	var te *transferError
+	if errors.As(err, &te) {
+		return te.Kind
+	}
+	return kindGeneral
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	return int(kindOf(err))
+}
+
+// apiError classifies an error message returned by the cowtransfer API.
+func apiError(msg string) error {
+	lower := strings.ToLower(msg)
+	switch {
+	case strings.Contains(lower, "login"), strings.Contains(msg, "登录"):
+		return errorf(kindAuth, "%s", msg)
+	case strings.Contains(lower, "quota"), strings.Contains(lower, "limit"),
+		strings.Contains(msg, "容量"), strings.Contains(msg, "超过"), strings.Contains(msg, "空间"):
+		return errorf(kindQuota, "%s", msg)
+	}
+	return errorf(kindGeneral, "%s", msg)
+}
+
+// combineErrors reduces the errors of total independent items to one: nil
+// when nothing failed, a partial failure when only some items failed and the
+// shared kind (or a general error) when everything failed.
+func combineErrors(errs []error, total int) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	if len(errs) < total {
+		return errorf(kindPartial, "%d of %d item(s) failed, first error: %v", len(errs), total, errs[0])
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	kind := kindOf(errs[0])
+	for _, err := range errs[1:] {
+		if kindOf(err) != kind {
+			kind = kindGeneral
+		}
+	}
+	return errorf(kind, "all %d item(s) failed, first error: %v", total, errs[0])
+}
+
+// maxRetries bounds how often a single part or range is attempted before the
+// transfer gives up with the last error.
+const maxRetries = 5
+
+func retryDelay(attempt int) time.Duration {
+	return time.Duration(attempt) * time.Second
+}
+
+// retryable reports whether another attempt can change the outcome. Auth,
+// deleted link and quota failures are final.
+func retryable(err error) bool {
+	switch kindOf(err) {
+	case kindUsage, kindAuth, kindDeleted, kindQuota:
+		return false
+	}
+	return true
+}
+
+// statusError classifies an unexpected HTTP status.
+func statusError(resp *http.Response) error {
+	switch code := resp.StatusCode; {
+	case code == http.StatusUnauthorized, code == http.StatusForbidden:
+		return errorf(kindAuth, "unexpected status %s", resp.Status)
+	case code == http.StatusNotFound, code == http.StatusGone:
+		return errorf(kindDeleted, "link unavailable, %s", resp.Status)
+	case code == http.StatusRequestEntityTooLarge:
+		return errorf(kindQuota, "unexpected status %s", resp.Status)
+	case code >= 500, code == http.StatusRequestTimeout, code == http.StatusTooManyRequests:
+		return errorf(kindNetwork, "unexpected status %s", resp.Status)
+	}
+	return errorf(kindGeneral, "unexpected status %s", resp.Status)
+}
+
+// firstError keeps the first error reported by a group of workers.
+type firstError struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (f *firstError) set(err error) {
+	f.mu.Lock()
+	if f.err == nil {
+		f.err = err
+	}
+	f.mu.Unlock()
+}
+
+func (f *firstError) get() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	archiveNone  = ""
+	archiveTar   = "tar"
+	archiveTarGz = "tar.gz"
+	archiveZip   = "zip"
+)
+
+func archiveKind(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return archiveTarGz
+	case strings.HasSuffix(name, ".tar"):
+		return archiveTar
+	case strings.HasSuffix(name, ".zip"):
+		return archiveZip
+	}
+	return archiveNone
+}
+
+// safeJoin joins an untrusted (remote supplied) name onto dir, refusing
+// absolute names and names that would escape dir through "..".
+func safeJoin(dir, name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("unsafe path: %s", name)
+	}
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("unsafe path: %s", name)
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+// downloadExtract unpacks an archive into the download prefix. Tar archives
+// are extracted while downloading unless the archive itself is kept; zip
+// needs random access, so it is always saved first.
+func downloadExtract(item downloadDetailsBlock, link, kind string) error {
+	dir := runConfig.prefix
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	fmt.Printf("Extract to: %s\n", dir)
+	numSize, err := strconv.ParseFloat(item.Size, 10)
+	if err != nil {
+		return fmt.Errorf("failed Parsing with error: %s, onfile: %s", err, item.FileName)
+	}
+	bar := progress.start(item.FileName, int64(numSize*1024))
+	defer progress.finish(bar)
+
+	if kind != archiveZip && !runConfig.keepArchive {
+		pr, pw := io.Pipe()
+		errCh := make(chan error, 1)
+		go func() {
+			err := streamFile(pw, link, bar)
+			_ = pw.CloseWithError(err)
+			errCh <- err
+		}()
+		err = extractTar(pr, dir, kind == archiveTarGz)
+		if err == nil {
+			// drain trailing padding so the download can finish.
+			_, err = io.Copy(ioutil.Discard, pr)
+		}
+		_ = pr.CloseWithError(err)
+		if dlErr := <-errCh; dlErr != nil && err == nil {
+			err = dlErr
+		}
+		if err != nil {
+			return fmt.Errorf("extract returns error: %s, onfile: %s", err, item.FileName)
+		}
+		return nil
+	}
+
+	archive, err := safeJoin(dir, item.FileName)
+	if err != nil {
+		return err
+	}
+	if err = downloadFile(archive, link, bar); err != nil {
+		return fmt.Errorf("failed DownloadConfig with error: %s, onfile: %s", err, item.FileName)
+	}
+	if kind == archiveZip {
+		err = extractZip(archive, dir)
+	} else {
+		var f *os.File
+		if f, err = os.Open(archive); err == nil {
+			err = extractTar(f, dir, kind == archiveTarGz)
+			_ = f.Close()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("extract returns error: %s, onfile: %s", err, item.FileName)
+	}
+	if !runConfig.keepArchive {
+		return os.Remove(archive)
+	}
+	return nil
+}
+
+func extractTar(r io.Reader, dir string, gz bool) error {
+	if gz {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("open gzip returns error: %v", err)
+		}
+		defer func() {
+			_ = zr.Close()
+		}()
+		r = zr
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read tar returns error: %v", err)
+		}
+		target, err := safeJoin(dir, hdr.Name)
+		if err != nil {
+			fmt.Printf("skipping %s: %v\n", hdr.Name, err)
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = extractEntry(tr, target, hdr.FileInfo().Mode())
+		default:
+			fmt.Printf("skipping %s: unsupported entry type\n", hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(path, dir string) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return fmt.Errorf("open zip returns error: %v", err)
+	}
+	defer func() {
+		_ = zr.Close()
+	}()
+	for _, f := range zr.File {
+		target, err := safeJoin(dir, f.Name)
+		if err != nil {
+			fmt.Printf("skipping %s: %v\n", f.Name, err)
+			continue
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			fmt.Printf("skipping %s: unsupported entry type\n", f.Name)
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("open zip entry returns error: %v, onfile: %s", err, f.Name)
+		}
+		err = extractEntry(rc, target, f.Mode())
+		_ = rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractEntry(r io.Reader, target string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		_ = out.Close()
+		return fmt.Errorf("extract returns error: %v, onfile: %s", err, target)
+	}
+	return out.Close()
+}
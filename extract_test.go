@@ -0,0 +1,175 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSafeJoin(t *testing.T) {
+	dir := filepath.Join("base", "dir")
+	cases := []struct {
+		name string
+		want string
+	}{
+		{name: "a.txt", want: "a.txt"},
+		{name: "a/b.txt", want: "a/b.txt"},
+		{name: "a\\b.txt", want: "a/b.txt"},
+		{name: "./a.txt", want: "a.txt"},
+		{name: "a/../b.txt", want: "b.txt"},
+		{name: "..a", want: "..a"},
+		{name: "../x"},
+		{name: "a/../../x"},
+		{name: "..\\x"},
+		{name: "a\\..\\..\\x"},
+		{name: ".."},
+		{name: "."},
+		{name: ""},
+		{name: "/etc/passwd"},
+		{name: "\\etc\\passwd"},
+		{name: "\\\\server\\share\\x"},
+	}
+	for _, c := range cases {
+		got, err := safeJoin(dir, c.name)
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("safeJoin(%q) = %q, want an error", c.name, got)
+			}
+			continue
+		}
+		if want := filepath.Join(dir, filepath.FromSlash(c.want)); err != nil || got != want {
+			t.Errorf("safeJoin(%q) = %q, %v, want %q", c.name, got, err, want)
+		}
+	}
+}
+
+// archiveEntry is one entry of a test archive; link makes it a symlink.
+type archiveEntry struct {
+	name, body, link string
+}
+
+// hostileEntries escape the extraction directory in every way safeJoin
+// refuses, and through a symlink followed by an entry below it.
+var hostileEntries = []archiveEntry{
+	{name: "ok.txt", body: "ok"},
+	{name: "../outside.txt", body: "evil"},
+	{name: "a/../../outside.txt", body: "evil"},
+	{name: "..\\outside.txt", body: "evil"},
+	{name: "/tmp/outside.txt", body: "evil"},
+	{name: "link", link: ".."},
+	{name: "link/outside.txt", body: "evil"},
+}
+
+// checkExtracted verifies that only the expected files exist below root,
+// where the archive was extracted into root/prefix.
+func checkExtracted(t *testing.T, root string) {
+	t.Helper()
+	var got []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			t.Errorf("symlink %s created", path)
+		}
+		if !info.IsDir() {
+			rel, _ := filepath.Rel(root, path)
+			got = append(got, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	want := []string{"archive", "prefix/link/outside.txt", "prefix/ok.txt"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("files after extraction %q, want %q", got, want)
+	}
+}
+
+func TestExtractTarHostileEntries(t *testing.T) {
+	for _, gz := range []bool{false, true} {
+		var buf bytes.Buffer
+		w := tar.NewWriter(&buf)
+		for _, e := range hostileEntries {
+			hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+			if e.link != "" {
+				hdr = &tar.Header{Name: e.name, Mode: 0777, Linkname: e.link, Typeflag: tar.TypeSymlink}
+			}
+			if err := w.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		if gz {
+			var zbuf bytes.Buffer
+			zw := gzip.NewWriter(&zbuf)
+			_, _ = zw.Write(data)
+			_ = zw.Close()
+			data = zbuf.Bytes()
+		}
+
+		root := t.TempDir()
+		archive := filepath.Join(root, "archive")
+		if err := os.WriteFile(archive, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = extractTar(f, filepath.Join(root, "prefix"), gz)
+		_ = f.Close()
+		if err != nil {
+			t.Fatalf("gzip %v: extractTar: %v", gz, err)
+		}
+		checkExtracted(t, root)
+	}
+}
+
+func TestExtractZipHostileEntries(t *testing.T) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, e := range hostileEntries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		hdr.SetMode(0644)
+		body := e.body
+		if e.link != "" {
+			hdr.SetMode(os.ModeSymlink | 0777)
+			body = e.link
+		}
+		fw, err := w.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	root := t.TempDir()
+	archive := filepath.Join(root, "archive")
+	if err := os.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := extractZip(archive, filepath.Join(root, "prefix")); err != nil {
+		t.Fatalf("extractZip: %v", err)
+	}
+	checkExtracted(t, root)
+}
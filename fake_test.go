@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCowtransfer stands in for the cowtransfer API, the upload storage and
+// the download host. Uploaded files are kept and offered for download as
+// the transfer shareID, and webhook payloads posted to /hook are collected.
+type fakeCowtransfer struct {
+	mu       sync.Mutex
+	url      string
+	partCode int
+	parts    int
+	merged   bool
+	events   []hookEvent
+	// announced is the file size sent with beforeupload.
+	announced []string
+	// pending holds the parts of the object being uploaded by part number.
+	pending map[int][]byte
+	// discard drops the part data after hashing it, so that benchmarks
+	// measure the memory of the uploader rather than of the fake.
+	discard bool
+	names   []string
+	files   map[string][]byte
+	// code is the short download code resolving to the transfer, and
+	// codeError the error message returned for any code when set.
+	code      string
+	codeError string
+	lookups   []string
+	deleted   bool
+}
+
+const fakeShareID = "c855d66abd524b"
+
+func (f *fakeCowtransfer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch path := r.URL.Path; {
+	case path == "/hook":
+		var ev hookEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.events = append(f.events, ev)
+	case path == prepareSend:
+		_ = json.NewEncoder(w).Encode(prepareSendResp{
+			UploadToken:  "uptoken",
+			TransferGUID: "transfer",
+			UniqueURL:    "https://cowtransfer.com/s/" + fakeShareID,
+			Prefix:       "prefix",
+		})
+	case path == setPassword:
+		_, _ = io.WriteString(w, "true")
+	case path == beforeUpload:
+		f.announced = append(f.announced, r.FormValue("fileSize"))
+		_ = json.NewEncoder(w).Encode(beforeSendResp{FileGuid: "file"})
+	case path == uploadFinish:
+		_, _ = io.WriteString(w, "true")
+	case path == uploadComplete:
+		_ = json.NewEncoder(w).Encode(finishResponse{TempDownloadCode: "123456", Status: true})
+	case strings.HasSuffix(path, "/uploads"):
+		f.pending = make(map[int][]byte)
+		_ = json.NewEncoder(w).Encode(map[string]string{"uploadId": "upload"})
+	case r.Method == "PUT" && strings.Contains(path, "/uploads/upload/"):
+		if f.partCode != 0 {
+			w.WriteHeader(f.partCode)
+			return
+		}
+		n, _ := strconv.Atoi(path[strings.LastIndex(path, "/")+1:])
+		// parts are received concurrently, as by the real storage.
+		discard := f.discard
+		f.mu.Unlock()
+		h := md5.New()
+		var data []byte
+		if discard {
+			_, _ = io.Copy(h, r.Body)
+		} else {
+			data, _ = io.ReadAll(r.Body)
+			h.Write(data)
+		}
+		f.mu.Lock()
+		f.pending[n] = data
+		sum := fmt.Sprintf("%x", h.Sum(nil))
+		f.parts++
+		_ = json.NewEncoder(w).Encode(upResp{Etag: sum, MD5: sum})
+	case strings.HasSuffix(path, "/uploads/upload"):
+		var merge clds
+		_ = json.NewDecoder(r.Body).Decode(&merge)
+		f.merged = len(merge.Parts) == len(f.pending)
+		var buf bytes.Buffer
+		for _, p := range merge.Parts {
+			buf.Write(f.pending[int(p.Part)])
+		}
+		if f.files == nil {
+			f.files = make(map[string][]byte)
+		}
+		f.names = append(f.names, merge.FName)
+		f.files[merge.FName] = buf.Bytes()
+		_ = json.NewEncoder(w).Encode(uploadResult{Hash: "hash"})
+	case path == "/api/transfer/v2/transferbytempcode":
+		resp := downloadCodeResponse{}
+		f.lookups = append(f.lookups, r.FormValue("code"))
+		switch {
+		case f.codeError != "":
+			resp.Error, resp.ErrorMessage = true, f.codeError
+		case f.code != "" && r.FormValue("code") == f.code:
+			resp.UniqueURL = "https://cowtransfer.com/s/" + fakeShareID
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	case path == "/api/transfer/transferdetail":
+		resp := downloadDetailsResponse{}
+		if r.FormValue("url") == fakeShareID {
+			resp = downloadDetailsResponse{GUID: "transfer", Uploaded: true, Deleted: f.deleted}
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	case path == "/api/transfer/files":
+		resp := downloadFilesResponse{Pages: 1}
+		for _, name := range f.names {
+			resp.Details = append(resp.Details, downloadDetailsBlock{
+				GUID:     name,
+				FileName: name,
+				Size:     strconv.FormatFloat(float64(len(f.files[name]))/1024, 'f', 2, 64),
+			})
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	case path == "/api/transfer/download":
+		_ = json.NewEncoder(w).Encode(downloadConfigResponse{Link: f.url + "/file/" + r.FormValue("guid")})
+	case strings.HasPrefix(path, "/file/"):
+		data, ok := f.files[strings.TrimPrefix(path, "/file/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(data))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// addFile offers data for download as name in the fake transfer.
+func (f *fakeCowtransfer) addFile(name string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.files == nil {
+		f.files = make(map[string][]byte)
+	}
+	f.names = append(f.names, name)
+	f.files[name] = data
+}
+
+func withFakeCowtransfer(t testing.TB) (*fakeCowtransfer, string) {
+	fake := new(fakeCowtransfer)
+	srv := httptest.NewServer(fake)
+	fake.url = srv.URL
+	t.Cleanup(srv.Close)
+
+	// runConfig is shared with the flag package, so its value is restored
+	// rather than the pointer.
+	savedAPI, savedUpload, savedConf, savedReport := apiBase, uploadBase, *runConfig, report
+	apiBase, uploadBase, report = srv.URL, srv.URL, new(runReport)
+	runConfig.webhook = srv.URL + "/hook"
+	runConfig.historyDB = filepath.Join(t.TempDir(), "history.db")
+	runConfig.hashCheck = true
+	runConfig.noQR = true
+	t.Cleanup(func() {
+		apiBase, uploadBase, *runConfig, report = savedAPI, savedUpload, savedConf, savedReport
+	})
+
+	path := filepath.Join(t.TempDir(), "payload.bin")
+	if err := os.WriteFile(path, []byte(strings.Repeat("cowtransfer ", 1000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fake, path
+}
@@ -0,0 +1,13 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+import "os"
+
+type fileKey struct{}
+
+// fileKeyOf is not available here, the walker compares with os.SameFile.
+func fileKeyOf(info os.FileInfo) (fileKey, bool) {
+	return fileKey{}, false
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const ignoreFile = ".cowignore"
+
+// stringList is a flag.Value collecting every occurrence of a flag.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// ignoreRule is one line of gitignore syntax.
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+	// anchored rules match the path relative to their base directory,
+	// others match the base name at any depth.
+	anchored bool
+}
+
+type ruleSet struct {
+	base  string
+	rules []ignoreRule
+}
+
+// parseRule parses one line; ok is false for blank lines and comments.
+func parseRule(line string) (r ignoreRule, ok bool, err error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false, nil
+	}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		r.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false, nil
+	}
+	if r.re, err = regexp.Compile("^" + globToRegexp(line) + "$"); err != nil {
+		return ignoreRule{}, false, err
+	}
+	return r, true, nil
+}
+
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := classEnd(glob, i)
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i = end
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// classEnd returns the index of the "]" closing the bracket expression that
+// starts at glob[start], or -1. As in gitignore, a "]" right after "[" or
+// "[!" is a literal and POSIX classes like [:alpha:] are kept whole.
+func classEnd(glob string, start int) int {
+	j := start + 1
+	if j < len(glob) && (glob[j] == '!' || glob[j] == '^') {
+		j++
+	}
+	if j < len(glob) && glob[j] == ']' {
+		j++
+	}
+	for ; j < len(glob); j++ {
+		switch {
+		case strings.HasPrefix(glob[j:], "[:"):
+			if k := strings.Index(glob[j+2:], ":]"); k >= 0 {
+				j += k + 3
+			}
+		case glob[j] == ']':
+			return j
+		}
+	}
+	return -1
+}
+
+// newRuleSet parses lines, naming source (a flag or a file) in errors.
+func newRuleSet(base, source string, lines []string) (*ruleSet, error) {
+	set := &ruleSet{base: base}
+	for i, line := range lines {
+		r, ok, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern %q at %s:%d: %v", line, source, i+1, err)
+		}
+		if ok {
+			set.rules = append(set.rules, r)
+		}
+	}
+	return set, nil
+}
+
+func readRuleSet(base, path string) (*ruleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return newRuleSet(base, path, lines)
+}
+
+// match reports whether path is ignored (true, true), explicitly re-included
+// (false, true) or not mentioned (false, false) by the rule set.
+func (s *ruleSet) match(path string, isDir bool) (ignored, matched bool) {
+	rel, err := filepath.Rel(s.base, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false, false
+	}
+	rel = filepath.ToSlash(rel)
+	name := filepath.Base(path)
+	for _, r := range s.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		target := name
+		if r.anchored {
+			target = rel
+		}
+		if r.re.MatchString(target) {
+			ignored, matched = !r.negate, true
+		}
+	}
+	return ignored, matched
+}
+
+// walkFilter decides which files of a walked tree are uploaded, combining
+// --exclude, --exclude-from, --include and .cowignore files.
+type walkFilter struct {
+	root     string
+	excludes []*ruleSet
+	includes *ruleSet
+	ignores  map[string]*ruleSet
+	// broken keeps the parse error of a .cowignore, so that it is read
+	// once and nothing below it is uploaded unfiltered.
+	broken map[string]error
+}
+
+func newWalkFilter(root string) (*walkFilter, error) {
+	f := &walkFilter{root: root, ignores: make(map[string]*ruleSet), broken: make(map[string]error)}
+	if len(runConfig.excludes) > 0 {
+		set, err := newRuleSet(root, "--exclude", runConfig.excludes)
+		if err != nil {
+			return nil, wrapError(kindUsage, err)
+		}
+		f.excludes = append(f.excludes, set)
+	}
+	for _, path := range runConfig.excludeFrom {
+		set, err := readRuleSet(root, path)
+		if err != nil {
+			return nil, wrapError(kindUsage, err)
+		}
+		f.excludes = append(f.excludes, set)
+	}
+	if len(runConfig.includes) > 0 {
+		set, err := newRuleSet(root, "--include", runConfig.includes)
+		if err != nil {
+			return nil, wrapError(kindUsage, err)
+		}
+		f.includes = set
+	}
+	return f, nil
+}
+
+// ignoreSets returns the .cowignore rules of every directory from the walk
+// root down to dir, outermost first.
+func (f *walkFilter) ignoreSets(dir string) ([]*ruleSet, error) {
+	var dirs []string
+	for d := dir; ; d = filepath.Dir(d) {
+		dirs = append(dirs, d)
+		if d == f.root || d == filepath.Dir(d) {
+			break
+		}
+	}
+	var sets []*ruleSet
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		if err := f.broken[d]; err != nil {
+			return nil, err
+		}
+		set, ok := f.ignores[d]
+		if !ok {
+			var err error
+			set, err = readRuleSet(d, filepath.Join(d, ignoreFile))
+			if err != nil && !os.IsNotExist(err) {
+				f.broken[d] = err
+				return nil, err
+			}
+			f.ignores[d] = set
+		}
+		if set != nil {
+			sets = append(sets, set)
+		}
+	}
+	return sets, nil
+}
+
+func (f *walkFilter) skip(path string, isDir bool) (bool, error) {
+	if path == f.root {
+		return false, nil
+	}
+	ignored := false
+	sets, err := f.ignoreSets(filepath.Dir(path))
+	if err != nil {
+		return false, err
+	}
+	sets = append(sets, f.excludes...)
+	for _, set := range sets {
+		if ig, ok := set.match(path, isDir); ok {
+			ignored = ig
+		}
+	}
+	if ignored {
+		return true, nil
+	}
+	if f.includes != nil && !isDir {
+		inc, _ := f.includes.match(path, false)
+		return !inc, nil
+	}
+	return false, nil
+}
+
+// walkFiles calls fn for every regular file below root that passes the
+// upload filters. Symlinks are skipped unless --follow-symlinks is set (root
+// itself is always followed), directory cycles are detected, and devices,
+// FIFOs and sockets are skipped with a warning. Walk errors are reported to
+// fn with a nil info as filepath.Walk does; an error from fn stops the walk.
+func walkFiles(root string, fn filepath.WalkFunc) error {
+	root = filepath.Clean(root)
+	filter, err := newWalkFilter(root)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	w := &walker{filter: filter, fn: fn}
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		logs.Warn("skipping non-regular file", "path", root, "mode", info.Mode().String())
+		return nil
+	}
+	return w.walk(root, info)
+}
+
+type walker struct {
+	filter *walkFilter
+	fn     filepath.WalkFunc
+	// ancestors holds the directories on the path being walked, keyed by
+	// device and inode, so that only a symlink back into one of them is
+	// treated as a cycle. stack is the fallback where no key is available.
+	ancestors map[fileKey]bool
+	stack     []os.FileInfo
+}
+
+// enter pushes dir on the ancestor chain, reporting false if it is already
+// on it. Without --follow-symlinks the walk cannot loop and nothing is kept.
+func (w *walker) enter(dir os.FileInfo) bool {
+	if !runConfig.followSymlinks {
+		return true
+	}
+	if key, ok := fileKeyOf(dir); ok {
+		if w.ancestors[key] {
+			return false
+		}
+		if w.ancestors == nil {
+			w.ancestors = make(map[fileKey]bool)
+		}
+		w.ancestors[key] = true
+		return true
+	}
+	for _, v := range w.stack {
+		if os.SameFile(v, dir) {
+			return false
+		}
+	}
+	w.stack = append(w.stack, dir)
+	return true
+}
+
+func (w *walker) leave(dir os.FileInfo) {
+	if !runConfig.followSymlinks {
+		return
+	}
+	if key, ok := fileKeyOf(dir); ok {
+		delete(w.ancestors, key)
+		return
+	}
+	w.stack = w.stack[:len(w.stack)-1]
+}
+
+func (w *walker) walk(path string, info os.FileInfo) error {
+	if !info.IsDir() {
+		return w.fn(path, info, nil)
+	}
+	if !w.enter(info) {
+		logs.Warn("skipping symlink cycle", "path", path)
+		return nil
+	}
+	defer w.leave(info)
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return w.fn(path, info, err)
+	}
+	for _, entry := range entries {
+		child := filepath.Join(path, entry.Name())
+		ci, ok, err := w.resolve(child, entry)
+		if err != nil {
+			if err = w.fn(child, nil, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if !ok {
+			continue
+		}
+		skip, err := w.filter.skip(child, ci.IsDir())
+		if err != nil {
+			if err = w.fn(child, nil, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if skip {
+			logs.Debug("skipping filtered path", "path", child)
+			continue
+		}
+		if err := w.walk(child, ci); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve applies the hidden file, symlink and special file policy to a
+// directory entry, returning the info to walk it with.
+func (w *walker) resolve(path string, entry os.DirEntry) (os.FileInfo, bool, error) {
+	if runConfig.skipHidden && strings.HasPrefix(entry.Name(), ".") {
+		logs.Debug("skipping hidden path", "path", path)
+		return nil, false, nil
+	}
+	info, err := entry.Info()
+	if err != nil {
+		return nil, false, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if !runConfig.followSymlinks {
+			logs.Warn("skipping symlink, use --follow-symlinks to upload its target", "path", path)
+			return nil, false, nil
+		}
+		if info, err = os.Stat(path); err != nil {
+			logs.Warn("skipping broken symlink", "path", path, "error", err)
+			return nil, false, nil
+		}
+	}
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		logs.Warn("skipping non-regular file", "path", path, "mode", info.Mode().String())
+		return nil, false, nil
+	}
+	return info, true, nil
+}
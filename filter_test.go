@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	cases := []struct {
+		glob  string
+		match []string
+		miss  []string
+	}{
+		{"*.log", []string{"a.log", ".log"}, []string{"a/b.log", "a.logs"}},
+		{"file?.txt", []string{"file1.txt"}, []string{"file.txt", "file/.txt"}},
+		{"**/build", []string{"build", "a/build", "a/b/build"}, []string{"abuild", "build/x"}},
+		{"logs/**", []string{"logs/a", "logs/a/b"}, []string{"logs", "x/logs/a"}},
+		{"a/**/b", []string{"a/b", "a/x/b", "a/x/y/b"}, []string{"ab", "a/x/c"}},
+		{"[abc].go", []string{"a.go", "c.go"}, []string{"d.go", "ab.go"}},
+		{"[!abc].go", []string{"d.go"}, []string{"a.go"}},
+		{"[a-c]x", []string{"bx"}, []string{"dx"}},
+		{`\*.txt`, []string{"*.txt"}, []string{"a.txt"}},
+		{"[]x]", []string{"]", "x"}, []string{"a"}},
+		{"[!]x]", []string{"a"}, []string{"]", "x"}},
+		{"[[:alpha:]]", []string{"q", "Z"}, []string{"1", "_"}},
+		{"[]", []string{"[]"}, []string{"a"}},
+		{"[!]x", []string{"[!]x"}, []string{"ax"}},
+	}
+	for _, c := range cases {
+		re, err := regexp.Compile("^" + globToRegexp(c.glob) + "$")
+		if err != nil {
+			t.Errorf("%q: compile: %v", c.glob, err)
+			continue
+		}
+		for _, s := range c.match {
+			if !re.MatchString(s) {
+				t.Errorf("%q should match %q (regexp %s)", c.glob, s, re)
+			}
+		}
+		for _, s := range c.miss {
+			if re.MatchString(s) {
+				t.Errorf("%q should not match %q (regexp %s)", c.glob, s, re)
+			}
+		}
+	}
+}
+
+func TestParseRuleMalformed(t *testing.T) {
+	for _, line := range []string{"foo[z-a]", "[z-a]*"} {
+		if _, _, err := parseRule(line); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+	_, err := newRuleSet("/r", "--exclude", []string{"*.log", "foo[z-a]"})
+	if err == nil || !strings.Contains(err.Error(), "foo[z-a]") || !strings.Contains(err.Error(), "--exclude:2") {
+		t.Errorf("error should name pattern and position, got %v", err)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, ignoreFile)
+	if err := os.WriteFile(path, []byte("# comment\n\n[z-a]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = readRuleSet(dir, path)
+	if err == nil || !strings.Contains(err.Error(), path+":3") {
+		t.Errorf("error should name %s:3, got %v", path, err)
+	}
+}
+
+func TestRuleSetMatch(t *testing.T) {
+	set, err := newRuleSet("/r", "test", []string{
+		"*.log",
+		"!keep.log",
+		"/build",
+		"docs/*.md",
+		"tmp/",
+		`\!bang`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+		matched bool
+	}{
+		{"/r/a.log", false, true, true},
+		{"/r/sub/a.log", false, true, true},
+		{"/r/keep.log", false, false, true},
+		{"/r/sub/keep.log", false, false, true},
+		{"/r/build", true, true, true},
+		{"/r/sub/build", true, false, false},
+		{"/r/docs/a.md", false, true, true},
+		{"/r/sub/docs/a.md", false, false, false},
+		{"/r/tmp", true, true, true},
+		{"/r/tmp", false, false, false},
+		{"/r/!bang", false, true, true},
+		{"/r/main.go", false, false, false},
+		{"/r/..a.log", false, true, true},
+		{"/r/.../a.log", false, true, true},
+		{"/r/...", true, false, false},
+		{"/other/a.log", false, false, false},
+		{"/a.log", false, false, false},
+	}
+	for _, c := range cases {
+		ignored, matched := set.match(c.path, c.isDir)
+		if ignored != c.ignored || matched != c.matched {
+			t.Errorf("match(%q, %v) = %v, %v, want %v, %v", c.path, c.isDir, ignored, matched, c.ignored, c.matched)
+		}
+	}
+}
+
+// buildTree creates files and directories below root; entries ending in "/"
+// are directories and "name -> target" entries are symlinks.
+func buildTree(t *testing.T, root string, entries []string) {
+	t.Helper()
+	for _, e := range entries {
+		var err error
+		switch {
+		case strings.Contains(e, " -> "):
+			parts := strings.SplitN(e, " -> ", 2)
+			err = os.Symlink(parts[1], filepath.Join(root, parts[0]))
+		case strings.HasSuffix(e, "/"):
+			err = os.MkdirAll(filepath.Join(root, e), 0755)
+		default:
+			err = os.WriteFile(filepath.Join(root, e), []byte(e), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func walkedFiles(t *testing.T, root string, follow bool) []string {
+	t.Helper()
+	saved := runConfig.followSymlinks
+	runConfig.followSymlinks = follow
+	defer func() { runConfig.followSymlinks = saved }()
+	var got []string
+	err := walkFiles(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		got = append(got, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestWalkFilesSymlinks(t *testing.T) {
+	cases := []struct {
+		name   string
+		tree   []string
+		follow bool
+		walked []string
+	}{
+		{
+			name:   "not followed",
+			tree:   []string{"a/", "a/x", "b -> a", "y -> a/x"},
+			walked: []string{"a/x"},
+		},
+		{
+			name:   "sibling links to the same directory",
+			tree:   []string{"a/", "a/x", "b -> a", "c -> a"},
+			follow: true,
+			walked: []string{"a/x", "b/x", "c/x"},
+		},
+		{
+			name:   "link back to an ancestor",
+			tree:   []string{"a/", "a/b/", "a/b/x", "a/b/up -> ../..", "a/b/self -> ."},
+			follow: true,
+			walked: []string{"a/b/x"},
+		},
+		{
+			name:   "mutual links",
+			tree:   []string{"a/", "b/", "a/x", "b/y", "a/tob -> ../b", "b/toa -> ../a"},
+			follow: true,
+			walked: []string{"a/tob/y", "a/x", "b/toa/x", "b/y"},
+		},
+		{
+			name:   "broken link",
+			tree:   []string{"a/", "a/x", "a/gone -> ../missing"},
+			follow: true,
+			walked: []string{"a/x"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			root := t.TempDir()
+			buildTree(t, root, c.tree)
+			got := walkedFiles(t, root, c.follow)
+			if strings.Join(got, ",") != strings.Join(c.walked, ",") {
+				t.Fatalf("walked %q, want %q", got, c.walked)
+			}
+		})
+	}
+}
+
+func TestWalkFilesDeepTree(t *testing.T) {
+	root := t.TempDir()
+	dir := root
+	for i := 0; i < 200; i++ {
+		dir = filepath.Join(dir, "d")
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "f"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := walkedFiles(t, root, true); len(got) != 200 {
+		t.Fatalf("walked %d files, want 200", len(got))
+	}
+}
+
+// captureLogs collects the log output until the test ends.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	logs.sink.mu.Lock()
+	saved := logs.sink.out
+	logs.sink.out = buf
+	logs.sink.mu.Unlock()
+	t.Cleanup(func() {
+		logs.sink.mu.Lock()
+		logs.sink.out = saved
+		logs.sink.mu.Unlock()
+	})
+	return buf
+}
+
+func TestWalkFilesSkipHidden(t *testing.T) {
+	root := filepath.Join(t.TempDir(), ".root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	buildTree(t, root, []string{
+		"a.txt", ".env", ".git/", ".git/config", "sub/", "sub/.hidden", "sub/b.txt",
+		"sub/.cache/", "sub/.cache/c.txt", "..d",
+	})
+	saved := runConfig.skipHidden
+	defer func() { runConfig.skipHidden = saved }()
+
+	runConfig.skipHidden = false
+	all := []string{"..d", ".env", ".git/config", "a.txt", "sub/.cache/c.txt", "sub/.hidden", "sub/b.txt"}
+	if got := walkedFiles(t, root, false); strings.Join(got, ",") != strings.Join(all, ",") {
+		t.Fatalf("walked %q, want %q", got, all)
+	}
+
+	// the hidden root itself is still walked.
+	runConfig.skipHidden = true
+	want := []string{"a.txt", "sub/b.txt"}
+	if got := walkedFiles(t, root, false); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("walked %q with --skip-hidden, want %q", got, want)
+	}
+}
@@ -0,0 +1,38 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestWalkFilesFIFO(t *testing.T) {
+	root := t.TempDir()
+	buildTree(t, root, []string{"a.txt", "sub/"})
+	fifo := filepath.Join(root, "sub", "pipe")
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Skipf("mkfifo: %v", err)
+	}
+	out := captureLogs(t)
+
+	if got := walkedFiles(t, root, false); strings.Join(got, ",") != "a.txt" {
+		t.Fatalf("walked %q, want only a.txt", got)
+	}
+	if !strings.Contains(out.String(), "skipping non-regular file") || !strings.Contains(out.String(), fifo) {
+		t.Fatalf("no warning for the FIFO in %q", out.String())
+	}
+
+	// a FIFO named on the command line is skipped as well, without
+	// blocking on open.
+	out.Reset()
+	if got := walkedFiles(t, fifo, false); len(got) != 0 {
+		t.Fatalf("walked %q, want nothing", got)
+	}
+	if !strings.Contains(out.String(), "skipping non-regular file") {
+		t.Fatalf("no warning for the FIFO in %q", out.String())
+	}
+}
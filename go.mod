@@ -1,13 +1,24 @@
 module cowtransfer-uploader
 
-go 1.16
+go 1.18
 
 require (
-	github.com/VividCortex/ewma v1.2.0 // indirect
 	github.com/cheggaaa/pb/v3 v3.0.8
+	github.com/klauspost/compress v1.15.9
+	github.com/klauspost/reedsolomon v1.9.16
+	github.com/orcaman/concurrent-map v1.0.0
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/sys v0.0.0-20220209214540-3681064d5158
+	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211
+	rsc.io/qr v0.2.0
+)
+
+require (
+	github.com/VividCortex/ewma v1.2.0 // indirect
 	github.com/fatih/color v1.13.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.6 // indirect
 	github.com/mattn/go-colorable v0.1.12 // indirect
+	github.com/mattn/go-isatty v0.0.14 // indirect
 	github.com/mattn/go-runewidth v0.0.13 // indirect
-	github.com/orcaman/concurrent-map v1.0.0
-	golang.org/x/sys v0.0.0-20220209214540-3681064d5158 // indirect
+	github.com/rivo/uniseg v0.2.0 // indirect
 )
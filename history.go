@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var historyBucket = []byte("transfers")
+
+type historyFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	MD5  string `json:"md5"`
+}
+
+type historyRecord struct {
+	ID   uint64    `json:"id"`
+	Time time.Time `json:"time"`
+	Link string    `json:"link"`
+	Code string    `json:"code"`
+	// HasPassword records whether the transfer is protected; the password
+	// itself is never stored.
+	HasPassword bool          `json:"hasPassword,omitempty"`
+	ValidDays   int           `json:"validDays"`
+	Files       []historyFile `json:"files"`
+}
+
+func (r *historyRecord) size() int64 {
+	total := int64(0)
+	for _, f := range r.Files {
+		total += f.Size
+	}
+	return total
+}
+
+func (r *historyRecord) match(term string) bool {
+	term = strings.ToLower(term)
+	fields := []string{r.Link, r.Code, r.Time.Format("2006-01-02 Mon")}
+	for _, f := range r.Files {
+		fields = append(fields, f.Path, f.MD5)
+	}
+	for _, v := range fields {
+		if strings.Contains(strings.ToLower(v), term) {
+			return true
+		}
+	}
+	return false
+}
+
+func historyPath() string {
+	if runConfig.historyDB != "" {
+		return runConfig.historyDB
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "cowtransfer-uploader", "history.db")
+}
+
+func openHistory() (*bolt.DB, error) {
+	p := historyPath()
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return nil, err
+	}
+	return bolt.Open(p, 0600, &bolt.Options{Timeout: 5 * time.Second})
+}
+
+func saveHistory(record *historyRecord) error {
+	if runConfig.noHistory {
+		return nil
+	}
+	db, err := openHistory()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(historyBucket)
+		if err != nil {
+			return err
+		}
+		record.ID, err = b.NextSequence()
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return b.Put(historyKey(record.ID), data)
+	})
+}
+
+func historyKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+func loadHistory(filter func(*historyRecord) bool) ([]*historyRecord, error) {
+	db, err := openHistory()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	records := make([]*historyRecord, 0)
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			record := new(historyRecord)
+			if err := json.Unmarshal(v, record); err != nil {
+				return fmt.Errorf("corrupted history record %x: %v", k, err)
+			}
+			if filter == nil || filter(record) {
+				records = append(records, record)
+			}
+			return nil
+		})
+	})
+	return records, err
+}
+
+func runHistory(args []string) error {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch args[0] {
+	case "list":
+		records, err := loadHistory(nil)
+		if err != nil {
+			return err
+		}
+		printHistory(records)
+	case "search":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: history search <term>")
+		}
+		term := strings.Join(args[1:], " ")
+		records, err := loadHistory(func(r *historyRecord) bool { return r.match(term) })
+		if err != nil {
+			return err
+		}
+		printHistory(records)
+	case "show":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: history show <id>")
+		}
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid history id: %s", args[1])
+		}
+		records, err := loadHistory(func(r *historyRecord) bool { return r.ID == id })
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			return fmt.Errorf("history record %d not found", id)
+		}
+		showHistory(records[0])
+	case "export":
+		records, err := loadHistory(nil)
+		if err != nil {
+			return err
+		}
+		out := os.Stdout
+		name := ""
+		if len(args) > 1 && args[1] != "-" {
+			name = args[1]
+			out, err = os.Create(name)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = out.Close()
+			}()
+		}
+		if strings.HasSuffix(name, ".csv") {
+			return exportHistoryCSV(out, records)
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	default:
+		return fmt.Errorf("unknown history command: %s (list|show|search|export)", args[0])
+	}
+	return nil
+}
+
+func printHistory(records []*historyRecord) {
+	fmt.Printf("%-6s%-18s%-8s%-12s%-10s%s\n", "ID", "Time", "Files", "Size", "Code", "Link")
+	for _, r := range records {
+		fmt.Printf("%-6d%-18s%-8d%-12d%-10s%s\n", r.ID, r.Time.Format("2006-01-02 15:04"),
+			len(r.Files), r.size(), r.Code, r.Link)
+	}
+}
+
+func showHistory(r *historyRecord) {
+	fmt.Printf("ID: %d\n", r.ID)
+	fmt.Printf("Time: %s\n", r.Time.Format(time.RFC1123))
+	fmt.Printf("Link: %s\n", r.Link)
+	fmt.Printf("Short Download Code: %s\n", r.Code)
+	if r.HasPassword {
+		fmt.Printf("Password: set\n")
+	}
+	if r.ValidDays > 0 {
+		fmt.Printf("Valid Days: %d (until %s)\n", r.ValidDays, r.Time.AddDate(0, 0, r.ValidDays).Format("2006-01-02"))
+	}
+	fmt.Printf("Files:\n")
+	for _, f := range r.Files {
+		fmt.Printf("  %s  %d  %s\n", f.MD5, f.Size, f.Path)
+	}
+}
+
+func exportHistoryCSV(w io.Writer, records []*historyRecord) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"id", "time", "link", "code", "validDays", "path", "size", "md5"})
+	for _, r := range records {
+		for _, f := range r.Files {
+			_ = cw.Write([]string{
+				strconv.FormatUint(r.ID, 10), r.Time.Format(time.RFC3339), r.Link, r.Code,
+				strconv.Itoa(r.ValidDays), f.Path, strconv.FormatInt(f.Size, 10), f.MD5,
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHistoryKeepsNoPassword(t *testing.T) {
+	_, path := withFakeCowtransfer(t)
+	runConfig.passCode = "s3cret-passcode"
+
+	if err := upload([]string{path}); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	records, err := loadHistory(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || !records[0].HasPassword {
+		t.Fatalf("records = %+v, want one with HasPassword", records)
+	}
+
+	for _, name := range []string{"history.json", "history.csv"} {
+		out := filepath.Join(t.TempDir(), name)
+		if err := runHistory([]string{"export", out}); err != nil {
+			t.Fatalf("export %s: %v", name, err)
+		}
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), runConfig.passCode) {
+			t.Fatalf("%s contains the password:\n%s", name, data)
+		}
+	}
+	raw, err := os.ReadFile(runConfig.historyDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), runConfig.passCode) {
+		t.Fatal("history database contains the password")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// hookEvent is sent to --on-complete on stdin and to --webhook as the body.
+// Text makes the payload usable as a Slack or Mattermost incoming webhook
+// message, the other fields are for scripts.
+type hookEvent struct {
+	Text   string     `json:"text"`
+	Status string     `json:"status"`
+	Link   string     `json:"link,omitempty"`
+	Code   string     `json:"code,omitempty"`
+	Files  []hookFile `json:"files"`
+	Error  string     `json:"error,omitempty"`
+}
+
+type hookFile struct {
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+func newHookEvent(link, code string, entries []*reportEntry, err error) *hookEvent {
+	ev := &hookEvent{Status: "success", Link: link, Code: code, Files: []hookFile{}}
+	var names []string
+	for _, e := range entries {
+		ev.Files = append(ev.Files, hookFile{Path: e.Path, Bytes: e.Bytes})
+		names = append(names, e.Path)
+	}
+	if err != nil {
+		ev.Status = "failed"
+		ev.Error = err.Error()
+		ev.Text = fmt.Sprintf("Upload of %s failed: %v", strings.Join(names, ", "), err)
+		return ev
+	}
+	ev.Text = fmt.Sprintf("Uploaded %s: %s", strings.Join(names, ", "), link)
+	if code != "" {
+		ev.Text += fmt.Sprintf(" (code %s)", code)
+	}
+	return ev
+}
+
+// runHooks runs --on-complete and posts --webhook for a finished transfer.
+// Hook failures are logged but never fail the transfer itself.
+func runHooks(link, code string, entries []*reportEntry, err error) {
+	if runConfig.onComplete == "" && runConfig.webhook == "" {
+		return
+	}
+	ev := newHookEvent(link, code, entries, err)
+	payload, jerr := json.Marshal(ev)
+	if jerr != nil {
+		logs.Warn("encode hook payload failed", "error", jerr)
+		return
+	}
+	if runConfig.onComplete != "" {
+		if err := runCommandHook(runConfig.onComplete, ev, payload); err != nil {
+			fmt.Printf("on-complete command returns error: %v\n", err)
+		}
+	}
+	if runConfig.webhook != "" {
+		if err := postWebhook(runConfig.webhook, payload); err != nil {
+			fmt.Printf("webhook returns error: %v\n", err)
+		}
+	}
+}
+
+// runCommandHook runs command through the shell with the event in
+// COWTRANSFER_* environment variables and as JSON on stdin.
+func runCommandHook(command string, ev *hookEvent, payload []byte) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	files := make([]string, 0, len(ev.Files))
+	for _, f := range ev.Files {
+		files = append(files, f.Path)
+	}
+	cmd.Env = append(os.Environ(),
+		"COWTRANSFER_STATUS="+ev.Status,
+		"COWTRANSFER_LINK="+ev.Link,
+		"COWTRANSFER_CODE="+ev.Code,
+		"COWTRANSFER_FILES="+strings.Join(files, "\n"),
+		"COWTRANSFER_ERROR="+ev.Error,
+	)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	logs.Debug("running on-complete command", "command", command, "status", ev.Status)
+	return cmd.Run()
+}
+
+func postWebhook(url string, payload []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	logs.Debug("posting webhook", "url", url)
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUploadWebhook(t *testing.T) {
+	fake, path := withFakeCowtransfer(t)
+
+	if err := upload([]string{path}); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if fake.parts == 0 || !fake.merged {
+		t.Fatalf("parts = %d, merged = %v", fake.parts, fake.merged)
+	}
+	if len(fake.events) != 1 {
+		t.Fatalf("%d webhook events, want 1", len(fake.events))
+	}
+	ev := fake.events[0]
+	if ev.Status != "success" || ev.Code != "123456" || ev.Link != "https://cowtransfer.com/s/c855d66abd524b" {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+	if len(ev.Files) != 1 || ev.Files[0].Path != path || ev.Files[0].Bytes != 12000 {
+		t.Fatalf("unexpected files %+v", ev.Files)
+	}
+	if !strings.Contains(ev.Text, "123456") {
+		t.Fatalf("text %q lacks the code", ev.Text)
+	}
+}
+
+func TestUploadWebhookFailure(t *testing.T) {
+	fake, path := withFakeCowtransfer(t)
+	fake.partCode = http.StatusUnauthorized
+
+	err := upload([]string{path})
+	if kindOf(err) != kindAuth {
+		t.Fatalf("err = %v (kind %d), want an auth error", err, kindOf(err))
+	}
+	if len(fake.events) != 1 || fake.events[0].Status != "failed" || fake.events[0].Error == "" {
+		t.Fatalf("unexpected events %+v", fake.events)
+	}
+}
+
+func TestFakeCowtransferRestoresConfig(t *testing.T) {
+	before := *runConfig
+	t.Run("upload", func(t *testing.T) {
+		_, _ = withFakeCowtransfer(t)
+		runConfig.passCode = "changed"
+	})
+	if !reflect.DeepEqual(*runConfig, before) {
+		t.Fatalf("runConfig leaked: %+v", *runConfig)
+	}
+}
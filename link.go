@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	linkIDRegex = regexp.MustCompile("^[0-9a-f]{14}$")
+	linkHosts   = []string{"cowtransfer.com", "c-t.work"}
+)
+
+type shareLink struct {
+	ID       string
+	Password string
+}
+
+type unsupportedLinkError struct {
+	Link   string
+	Reason string
+}
+
+func (e *unsupportedLinkError) Error() string {
+	return fmt.Sprintf("unsupported link %q: %s", e.Link, e.Reason)
+}
+
+// parseShareLink accepts links of the form https://cowtransfer.com/s/<id>,
+// https://c-t.work/s/<id> (or any subdomain of them), optionally carrying
+// the password as a ?password= or ?passcode= query parameter.
+func parseShareLink(v string) (*shareLink, error) {
+	raw := strings.TrimSpace(v)
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, &unsupportedLinkError{Link: v, Reason: err.Error()}
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, &unsupportedLinkError{Link: v, Reason: "unknown scheme " + u.Scheme}
+	}
+	if !isShareHost(u.Hostname()) {
+		return nil, &unsupportedLinkError{Link: v, Reason: "unknown host " + u.Hostname()}
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(segments) != 2 || segments[0] != "s" {
+		return nil, &unsupportedLinkError{Link: v, Reason: "path is not /s/<id>"}
+	}
+	id := strings.ToLower(segments[1])
+	if !linkIDRegex.MatchString(id) {
+		return nil, &unsupportedLinkError{Link: v, Reason: "malformed share id " + segments[1]}
+	}
+	link := &shareLink{ID: id}
+	query := u.Query()
+	for _, key := range []string{"password", "passcode", "pwd"} {
+		if p := query.Get(key); p != "" {
+			link.Password = p
+			break
+		}
+	}
+	return link, nil
+}
+
+func isShareHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range linkHosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+func isShareLink(v string) bool {
+	return strings.HasPrefix(v, "https://") || strings.HasPrefix(v, "http://")
+}
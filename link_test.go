@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseShareLink(t *testing.T) {
+	cases := []struct {
+		in       string
+		id       string
+		password string
+		err      bool
+	}{
+		{in: "https://cowtransfer.com/s/c855d66abd524b", id: "c855d66abd524b"},
+		{in: "http://cowtransfer.com/s/c855d66abd524b", id: "c855d66abd524b"},
+		{in: "https://c-t.work/s/c855d66abd524b", id: "c855d66abd524b"},
+		{in: "https://acme.cowtransfer.com/s/c855d66abd524b/", id: "c855d66abd524b"},
+		{in: "https://COWTRANSFER.com/s/C855D66ABD524B", id: "c855d66abd524b"},
+		{in: "  https://c-t.work/s/c855d66abd524b\n", id: "c855d66abd524b"},
+		{in: "c-t.work/s/c855d66abd524b", id: "c855d66abd524b"},
+		{in: "cowtransfer.com/s/c855d66abd524b", id: "c855d66abd524b"},
+		{in: "https://c-t.work/s/c855d66abd524b?password=123456", id: "c855d66abd524b", password: "123456"},
+		{in: "https://c-t.work/s/c855d66abd524b?passcode=abc", id: "c855d66abd524b", password: "abc"},
+		{in: "https://c-t.work/s/c855d66abd524b?pwd=x%26y", id: "c855d66abd524b", password: "x&y"},
+		{in: "https://c-t.work/s/c855d66abd524b?utm=1&password=p", id: "c855d66abd524b", password: "p"},
+		{in: "https://c-t.work/s/c855d66abd524b#password=frag", id: "c855d66abd524b"},
+		{in: "https://c-t.work/s/c855d66abd524b?password=q#frag", id: "c855d66abd524b", password: "q"},
+		{in: "c855d66abd524b", err: true},
+		{in: "123456", err: true},
+		{in: "", err: true},
+		{in: "ftp://cowtransfer.com/s/c855d66abd524b", err: true},
+		{in: "https://example.com/s/c855d66abd524b", err: true},
+		{in: "https://evilcowtransfer.com/s/c855d66abd524b", err: true},
+		{in: "https://cowtransfer.com.evil.com/s/c855d66abd524b", err: true},
+		{in: "https://cowtransfer.com/x/c855d66abd524b", err: true},
+		{in: "https://cowtransfer.com/s/c855d66abd524b/extra", err: true},
+		{in: "https://cowtransfer.com/s/c855d66abd52", err: true},
+		{in: "https://cowtransfer.com/s/zzzzzzzzzzzzzz", err: true},
+		{in: "https://cowtransfer.com/s/", err: true},
+		{in: "https://[::1/s/c855d66abd524b", err: true},
+	}
+	for _, c := range cases {
+		link, err := parseShareLink(c.in)
+		if c.err {
+			var ule *unsupportedLinkError
+			if !errors.As(err, &ule) {
+				t.Errorf("parseShareLink(%q) = %+v, %v, want unsupportedLinkError", c.in, link, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseShareLink(%q) returns error: %v", c.in, err)
+			continue
+		}
+		if link.ID != c.id || link.Password != c.password {
+			t.Errorf("parseShareLink(%q) = %+v, want id %q password %q", c.in, link, c.id, c.password)
+		}
+	}
+}
+
+func FuzzParseLink(f *testing.F) {
+	for _, seed := range []string{
+		"https://cowtransfer.com/s/c855d66abd524b",
+		"c-t.work/s/c855d66abd524b?password=123456",
+		"https://a.c-t.work/s/c855d66abd524b#x",
+		"c855d66abd524b",
+		"https://[::1]:80/s/",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, in string) {
+		link, err := parseShareLink(in)
+		if err != nil {
+			var ule *unsupportedLinkError
+			if !errors.As(err, &ule) {
+				t.Fatalf("unexpected error type %T: %v", err, err)
+			}
+			return
+		}
+		if !linkIDRegex.MatchString(link.ID) {
+			t.Fatalf("parseShareLink(%q) accepted malformed id %q", in, link.ID)
+		}
+		again, err := parseShareLink("https://cowtransfer.com/s/" + link.ID)
+		if err != nil || again.ID != link.ID {
+			t.Fatalf("id %q from %q does not round-trip: %v", link.ID, in, err)
+		}
+	})
+}
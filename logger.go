@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+const redacted = "[REDACTED]"
+
+var (
+	sensitiveKeys = []string{
+		"authorization", "cookie", "set-cookie", "cow-auth-token",
+		"passcode", "password", "token", "uptoken",
+	}
+	// the token and e (signature) query parameters sign download links.
+	sensitiveRe = regexp.MustCompile(`(?i)((?:cow-auth-token|remember-mev2|passcode|password|uptoken)` +
+		`(?:=|\s+|"\s*:\s*")|[?&](?:token|e)=)[^;&\s"]+`)
+)
+
+// logs is the program wide logger, configured by setupLogger. Fields added
+// with With are printed with every entry, e.g. the file and part number.
+var (
+	logs     = &logger{sink: &logSink{out: os.Stderr}}
+	logLimit = levelWarn
+)
+
+type logSink struct {
+	mu   sync.Mutex
+	out  io.Writer
+	json bool
+}
+
+type logger struct {
+	sink   *logSink
+	fields []interface{}
+}
+
+func setupLogger() error {
+	level := runConfig.logLevel
+	if level == "" {
+		level = "warn"
+		if runConfig.debugMode {
+			level = "debug"
+		}
+	}
+	logLimit = -1
+	for i, name := range levelNames {
+		if strings.EqualFold(level, name) {
+			logLimit = logLevel(i)
+		}
+	}
+	if logLimit < 0 {
+		return fmt.Errorf("unknown log level: %s (debug|info|warn|error)", level)
+	}
+	switch runConfig.logFormat {
+	case "", "text":
+	case "json":
+		logs.sink.json = true
+	default:
+		return fmt.Errorf("unknown log format: %s (text|json)", runConfig.logFormat)
+	}
+	if runConfig.logFile != "" {
+		f, err := os.OpenFile(runConfig.logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("open log file returns error: %v", err)
+		}
+		logs.sink.out = f
+	}
+	return nil
+}
+
+// With returns a logger that adds the given key/value pairs to each entry.
+func (l *logger) With(kv ...interface{}) *logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &logger{sink: l.sink, fields: fields}
+}
+
+func (l *logger) enabled(level logLevel) bool {
+	return level >= logLimit
+}
+
+func (l *logger) Debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+func (l *logger) Info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv) }
+func (l *logger) Warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv) }
+func (l *logger) Error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+func (l *logger) log(level logLevel, msg string, kv []interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+	fields := append(append([]interface{}{}, l.fields...), kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(missing)")
+	}
+	buf := new(bytes.Buffer)
+	now := time.Now().Format(time.RFC3339)
+	if l.sink.json {
+		buf.WriteString(`{"time":`)
+		writeJSON(buf, now)
+		buf.WriteString(`,"level":`)
+		writeJSON(buf, levelNames[level])
+		buf.WriteString(`,"msg":`)
+		writeJSON(buf, redactString(msg))
+		for i := 0; i < len(fields); i += 2 {
+			key := fmt.Sprint(fields[i])
+			buf.WriteByte(',')
+			writeJSON(buf, key)
+			buf.WriteByte(':')
+			writeJSON(buf, redactValue(key, fields[i+1]))
+		}
+		buf.WriteString("}\n")
+	} else {
+		fmt.Fprintf(buf, "%s %-5s %s", now, levelNames[level], redactString(msg))
+		for i := 0; i < len(fields); i += 2 {
+			key := fmt.Sprint(fields[i])
+			s := fmt.Sprint(redactValue(key, fields[i+1]))
+			if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+				s = strconv.Quote(s)
+			}
+			fmt.Fprintf(buf, " %s=%s", key, s)
+		}
+		buf.WriteByte('\n')
+	}
+	l.sink.mu.Lock()
+	_, _ = l.sink.out.Write(buf.Bytes())
+	l.sink.mu.Unlock()
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(data)
+}
+
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, k := range sensitiveKeys {
+		if key == k {
+			return true
+		}
+	}
+	return false
+}
+
+func redactValue(key string, v interface{}) interface{} {
+	if isSensitive(key) {
+		return redacted
+	}
+	switch v := v.(type) {
+	case string:
+		return redactString(v)
+	case []byte:
+		return redactString(string(v))
+	case error:
+		return redactString(v.Error())
+	case http.Header:
+		h := make(map[string]string, len(v))
+		for name := range v {
+			h[name] = fmt.Sprint(redactValue(name, v.Get(name)))
+		}
+		return h
+	case map[string]string:
+		m := make(map[string]string, len(v))
+		for name, val := range v {
+			m[name] = fmt.Sprint(redactValue(name, val))
+		}
+		return m
+	}
+	return v
+}
+
+func redactString(s string) string {
+	return sensitiveRe.ReplaceAllString(s, "${1}"+redacted)
+}
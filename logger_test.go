@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestRedactString(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"remember-mev2=abc; cow-auth-token=def", "remember-mev2=[REDACTED]; cow-auth-token=[REDACTED]"},
+		{`{"passcode":"123456","uptoken": "x"}`, `{"passcode":"[REDACTED]","uptoken": "[REDACTED]"}`},
+		{"Authorization: UpToken abc:def", "Authorization: UpToken [REDACTED]"},
+		{"https://cowtransfer.com/api/transfer/transferdetail?url=x&passcode=1234", "https://cowtransfer.com/api/transfer/transferdetail?url=x&passcode=[REDACTED]"},
+		{"https://d.example.com/f.bin?e=1690000000&token=ak:sig=&attname=f.bin", "https://d.example.com/f.bin?e=[REDACTED]&token=[REDACTED]&attname=f.bin"},
+		{"https://d.example.com/f.bin?attname=f.bin&e=1690000000", "https://d.example.com/f.bin?attname=f.bin&e=[REDACTED]"},
+		{"https://d.example.com/f.bin?TOKEN=abc", "https://d.example.com/f.bin?TOKEN=[REDACTED]"},
+		// parameters that merely end in e or token are kept.
+		{"https://x/?size=10&name=e&mytoken=1", "https://x/?size=10&name=e&mytoken=1"},
+		{"token expired, retrying", "token expired, retrying"},
+	}
+	for _, c := range cases {
+		if got := redactString(c.in); got != c.want {
+			t.Errorf("redactString(%q)\n got %q\nwant %q", c.in, got, c.want)
+		}
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
-	"log"
 	"os"
 	"reflect"
 	"strings"
@@ -20,9 +19,14 @@ var (
 )
 
 type uploadPart struct {
-	content []byte
-	count   int64
-	bar     *pb.ProgressBar
+	offset int64
+	size   int64
+	count  int64
+	bar    *pb.ProgressBar
+	// data holds the part itself when it is not read from a file, release
+	// hands its buffer back once the part is done with.
+	data    []byte
+	release func()
 }
 
 func init() {
@@ -30,74 +34,178 @@ func init() {
 	addFlag(&runConfig.token, []string{"cookie", "c"}, "", "Your User cookie (optional)")
 	addFlag(&runConfig.parallel, []string{"parallel", "p"}, 3, "Parallel task count (default 3)")
 	addFlag(&runConfig.blockSize, []string{"block", "b"}, 1200000, "Upload Block Size (default 1200000)")
-	addFlag(&runConfig.interval, []string{"timeout", "t"}, 15, "Request retry/timeout limit (in second, default 10)")
-	addFlag(&runConfig.prefix, []string{"prefix", "o"}, ".", "File download dictionary/name (default \".\")")
+	addFlag(&runConfig.autoMode, []string{"auto"}, false, "Pick block size from file size and tune parallelism on the fly")
+	addFlag(&runConfig.interval, []string{"timeout", "t"}, 15, "Request/stalled download timeout (in second, default 15)")
+	addFlag(&runConfig.proxy, []string{"proxy"}, "", "Proxy URL, http(s)://[user:pass@]host:port or socks5://[user:pass@]host:port")
+	addFlag(&runConfig.noProxy, []string{"no-proxy"}, "", "Comma separated hosts, domains or CIDRs that bypass the proxy")
+	addFlag(&runConfig.caCert, []string{"ca-cert"}, "", "Extra trusted CA certificates (PEM file)")
+	addFlag(&runConfig.clientCert, []string{"client-cert"}, "", "TLS client certificate (PEM file)")
+	addFlag(&runConfig.clientKey, []string{"client-key"}, "", "TLS client private key (PEM file)")
+	addFlag(&runConfig.insecure, []string{"insecure"}, false, "Skip TLS certificate verification (unsafe)")
+	addFlag(&runConfig.prefix, []string{"prefix", "o"}, ".", "File download dictionary/name, \"-\" for stdout (default \".\")")
 	addFlag(&runConfig.singleMode, []string{"single", "s"}, false, "Single Upload Mode")
-	addFlag(&runConfig.debugMode, []string{"verbose", "v"}, false, "Verbose Mode")
+	addFlag(&runConfig.debugMode, []string{"verbose", "v"}, false, "Verbose Mode (same as --log-level debug)")
+	addFlag(&runConfig.logLevel, []string{"log-level"}, "", "Log level: debug, info, warn or error (default warn)")
+	addFlag(&runConfig.logFormat, []string{"log-format"}, "text", "Log format: text or json")
+	addFlag(&runConfig.logFile, []string{"log-file"}, "", "Write logs to file instead of stderr")
 	addFlag(&runConfig.keepMode, []string{"keep", "k"}, false, "Keep program active when upload finish")
 	addFlag(&runConfig.hashCheck, []string{"hash"}, false, "Check Hash after block upload (might slower)")
 	addFlag(&runConfig.passCode, []string{"password"}, "", "Set password")
+	addFlag(&runConfig.passwordFD, []string{"password-fd"}, -1, "Read download password from file descriptor (0 for stdin)")
 	addFlag(&runConfig.version, []string{"version"}, false, "Print version and exit")
 	addFlag(&runConfig.silentMode, []string{"silent"}, false, "Enable silent mode")
 	addFlag(&runConfig.validDays, []string{"valid"}, 0, "Valid Days")
+	addFlag(&runConfig.extract, []string{"extract", "x"}, false, "Extract tar/tar.gz/zip archives into prefix while downloading")
+	addFlag(&runConfig.keepArchive, []string{"keep-archive"}, false, "Keep the archive file after extracting")
+	addFlag(&runConfig.report, []string{"report"}, "", "Write an end-of-run upload report (.json or .csv)")
+	addFlag(&runConfig.reportSidecar, []string{"report-sidecar"}, false, "Write <file>.cowtransfer.json next to each uploaded file")
+	addFlag(&runConfig.excludes, []string{"exclude"}, []string{}, "Skip files matching glob (gitignore syntax, repeatable)")
+	addFlag(&runConfig.includes, []string{"include"}, []string{}, "Only upload files matching glob (repeatable)")
+	addFlag(&runConfig.excludeFrom, []string{"exclude-from"}, []string{}, "Read exclude patterns from file (repeatable)")
+	addFlag(&runConfig.followSymlinks, []string{"follow-symlinks"}, false, "Upload symlink targets and descend into symlinked directories")
+	addFlag(&runConfig.skipHidden, []string{"skip-hidden"}, false, "Skip files and directories starting with a dot")
+	addFlag(&runConfig.dryRun, []string{"dry-run"}, false, "Show what would be uploaded/downloaded without transferring")
+	addFlag(&runConfig.settle, []string{"settle"}, 5, "Watch: seconds a file must stay unchanged before upload")
+	addFlag(&runConfig.moveTo, []string{"move-to"}, "", "Watch: move files into this directory after upload")
+	addFlag(&runConfig.deleteAfter, []string{"delete-after"}, false, "Watch: delete files after upload")
+	addFlag(&runConfig.onComplete, []string{"on-complete"}, "", "Run command after each transfer (details in env and JSON stdin)")
+	addFlag(&runConfig.webhook, []string{"webhook"}, "", "POST a JSON (Slack/Mattermost compatible) notice to this URL")
+	addFlag(&runConfig.noQR, []string{"no-qr"}, false, "Do not print the share link as a QR code")
+	addFlag(&runConfig.qrFile, []string{"qr-file"}, "", "Also save the share link QR code as PNG")
+	addFlag(&runConfig.splitSize, []string{"split-size"}, "", "Upload files larger than this (e.g. 2G) as volumes")
+	addFlag(&runConfig.parity, []string{"parity"}, 0, "Add this many Reed-Solomon parity volumes to split files")
+	addFlag(&runConfig.compress, []string{"compress"}, "", "Compress files while uploading: zstd or gzip")
+	addFlag(&runConfig.decompress, []string{"decompress"}, false, "Decompress .zst/.gz files while downloading")
+	addFlag(&runConfig.historyDB, []string{"history-db"}, "", "Upload history database path")
+	addFlag(&runConfig.noHistory, []string{"no-history"}, false, "Do not record uploads in history")
 
 	flag.Usage = printUsage
-	flag.Parse()
 }
 
 func main() {
+	flag.Parse()
+	err := run()
+	progress.stop()
+	if runConfig.keepMode {
+		fmt.Print("Press the enter key to exit...")
+		reader := bufio.NewReader(os.Stdin)
+		_, _ = reader.ReadString('\n')
+	}
+	os.Exit(exitCode(err))
+}
+
+// isSubcommand reports whether arg selects the subcommand name. A local path
+// of that name is uploaded instead, so files called "watch", "repair" or
+// "history" are not taken over by the subcommands.
+func isSubcommand(arg, name string) bool {
+	return arg == name && !isExist(arg)
+}
+
+func run() error {
 	files := flag.Args()
 
 	if runConfig.version {
 		printVersion()
-		return
+		return nil
 	}
 
-	if runConfig.debugMode {
-		log.Printf("config = %+v", runConfig)
-		log.Printf("files = %s", files)
+	if isStdout(runConfig.prefix) {
+		redirectStdout()
+	}
+	if err := setupLogger(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return wrapError(kindUsage, err)
 	}
+	if err := setupTransport(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return wrapError(kindUsage, err)
+	}
+	if err := setupSplit(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return wrapError(kindUsage, err)
+	}
+	if err := setupCompress(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return wrapError(kindUsage, err)
+	}
+
+	logs.Debug("starting", "parallel", runConfig.parallel, "block", runConfig.blockSize,
+		"timeout", runConfig.interval, "single", runConfig.singleMode, "files", files)
 	if len(files) == 0 {
 		fmt.Printf("missing file(s) or url(s)\n")
 		printUsage()
-		return
+		return errorf(kindUsage, "missing file(s) or url(s)")
+	}
+	if isSubcommand(files[0], "watch") {
+		err := runWatch(files[1:])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		return err
+	}
+	if isSubcommand(files[0], "repair") {
+		return runRepair(files[1:])
+	}
+	if isSubcommand(files[0], "history") {
+		err := runHistory(files[1:])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		return err
 	}
 	// if runConfig.blockSize > 4194304 {
 	// 	runConfig.blockSize = 524288
 	// }
 
 	var f []string
+	var errs []error
+	total := 0
 	for _, v := range files {
 		var err error
-		if strings.HasPrefix(v, "https://") {
+		if isShareLink(v) {
 			// Download Mode
+			total++
 			err = download(v)
+		} else if isDownloadCode(v) {
+			total++
+			err = downloadCode(v)
 		} else {
 			f = append(f, v)
 		}
 		if err != nil {
-			fmt.Printf("Error: %v", err)
+			fmt.Printf("Error: %v\n", err)
+			errs = append(errs, err)
 		}
 	}
 	if len(f) != 0 {
-		upload(f)
-	}
-
-	if runConfig.keepMode {
-		fmt.Print("Press the enter key to exit...")
-		reader := bufio.NewReader(os.Stdin)
-		_, _ = reader.ReadString('\n')
+		total++
+		if err := upload(f); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			errs = append(errs, err)
+		}
 	}
+	return combineErrors(errs, total)
 }
 
 func printUsage() {
-	fmt.Printf("\nUsage:\n\n  %s [options] file(s)/url(s)\n\n", os.Args[0])
+	fmt.Printf("\nUsage:\n\n  %s [options] file(s)/url(s)/code(s)\n", os.Args[0])
+	fmt.Printf("  %s [options] history list|show <id>|search <term>|export [file]\n", os.Args[0])
+	fmt.Printf("  %s [options] watch <dir>\n", os.Args[0])
+	fmt.Printf("  %s [options] repair <file.cowsplit>...\n", os.Args[0])
+	fmt.Printf("\nA local file or directory named history, watch or repair is uploaded\n")
+	fmt.Printf("instead of running the command.\n\n")
 	fmt.Printf("Options:\n\n")
 	for _, val := range commands {
 		// s := fmt.Sprintf(" %s %s", val[0], val[1])
 		block := strings.Repeat(" ", 30-len(val[0]))
 		fmt.Printf("%s%s%s\n", val[0], block, val[2])
 	}
+	fmt.Printf("\nExit codes:\n\n")
+	fmt.Printf(" 0%s%s\n", strings.Repeat(" ", 29), "success")
+	for _, v := range exitCodes {
+		c := fmt.Sprintf(" %d", v.kind)
+		fmt.Printf("%s%s%s\n", c, strings.Repeat(" ", 30-len(c)), v.desc)
+	}
 	fmt.Printf("\n")
 }
 
@@ -126,6 +234,9 @@ func addFlag(p interface{}, cmd []string, val interface{}, usage string) {
 			flag.StringVar((*string)(ptr), item, val, usage)
 		case bool:
 			flag.BoolVar((*bool)(ptr), item, val, usage)
+		case []string:
+			s[1] = "list"
+			flag.Var((*stringList)(ptr), item, usage)
 		}
 	}
 	commands = append(commands, s)
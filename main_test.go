@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestIsSubcommand(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+
+	if !isSubcommand("watch", "watch") || !isSubcommand("history", "history") {
+		t.Fatal("subcommands not recognised without local paths")
+	}
+	if isSubcommand("watch", "history") {
+		t.Fatal("watch taken for history")
+	}
+	if err := os.WriteFile("history", []byte("notes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir("watch", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if isSubcommand("history", "history") || isSubcommand("watch", "watch") {
+		t.Fatal("local paths must be uploaded, not dispatched")
+	}
+	if !isSubcommand("repair", "repair") {
+		t.Fatal("repair not recognised")
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// Parity volumes protect the volumes of a split file (see splitIndex) with
+// Reed-Solomon erasure coding over GF(2^8), as implemented by
+// github.com/klauspost/reedsolomon with its default systematic matrix.
+//
+// Every volume is one data shard, zero padded to ShardSize; the last volume
+// is the only one that can be shorter. The index lists P parity shards of
+// exactly ShardSize bytes, named <name>.par.001 and up, which are uploaded
+// into the same transfer. Any P damaged or missing volumes, data or parity,
+// can be rebuilt from the others. Data and parity volumes together are
+// limited to 256.
+const (
+	parityScheme = "reed-solomon-gf8"
+	maxShards    = 256
+)
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// padReader pads r with zeros up to size bytes.
+func padReader(r io.Reader, n, size int64) io.Reader {
+	if n >= size {
+		return r
+	}
+	return io.MultiReader(r, io.LimitReader(zeroReader{}, size-n))
+}
+
+// uploadParity computes the --parity volumes of the volumes described by
+// index, uploads them and adds them to the index.
+func uploadParity(l *logger, file io.ReaderAt, index *splitIndex, baseConf *prepareSendResp) error {
+	count := runConfig.parity
+	if len(index.Volumes)+count > maxShards {
+		return errorf(kindUsage, "%d volume(s) and %d parity volume(s) exceed the limit of %d, raise --split-size",
+			len(index.Volumes), count, maxShards)
+	}
+	enc, err := reedsolomon.NewStream(len(index.Volumes), count)
+	if err != nil {
+		return err
+	}
+	index.Scheme, index.ShardSize = parityScheme, splitBytes
+
+	data := make([]io.Reader, len(index.Volumes))
+	for i, v := range index.Volumes {
+		data[i] = padReader(io.NewSectionReader(file, int64(i)*splitBytes, v.Size), v.Size, splitBytes)
+	}
+	files := make([]*os.File, count)
+	hashes := make([]hash.Hash, count)
+	parity := make([]io.Writer, count)
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				_ = f.Close()
+				_ = os.Remove(f.Name())
+			}
+		}
+	}()
+	// the parity volumes are staged in os.TempDir(), which honors $TMPDIR;
+	// they need count*splitBytes bytes, too much for a small tmpfs /tmp.
+	dir := os.TempDir()
+	for i := range files {
+		if files[i], err = os.CreateTemp(dir, "cowtransfer-parity-*"); err != nil {
+			return fmt.Errorf("create parity file returns error: %w (set TMPDIR to use another directory)", err)
+		}
+		hashes[i] = sha256.New()
+		parity[i] = io.MultiWriter(files[i], hashes[i])
+	}
+	fmt.Printf("Computing %d parity volume(s) in %s (%s)\n", count, dir, humanBytes(int64(count)*splitBytes))
+	if err := enc.Encode(data, parity); err != nil {
+		return fmt.Errorf("compute parity in %s returns error: %w (set TMPDIR to use another directory)", dir, err)
+	}
+
+	for i, f := range files {
+		v := splitVolume{
+			Name:   volumeName(index.Name+".par", i+1, count),
+			Size:   splitBytes,
+			SHA256: hexSum(hashes[i]),
+		}
+		fmt.Printf("Parity volume: %s\n", v.Name)
+		if err := uploadSection(l.With("volume", v.Name), f, volumeInfo{v.Name, v.Size}, baseConf); err != nil {
+			return err
+		}
+		index.Parity = append(index.Parity, v)
+	}
+	return nil
+}
+
+func checkVolume(path string, v splitVolume) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	return err == nil && n == v.Size && hexSum(h) == v.SHA256
+}
+
+// repairVolumes rebuilds damaged or missing volumes of index, stored in dir,
+// from its parity volumes.
+func repairVolumes(dir string, index *splitIndex) error {
+	if len(index.Parity) == 0 {
+		return nil
+	}
+	if index.Scheme != parityScheme {
+		return errorf(kindGeneral, "unsupported parity scheme %q", index.Scheme)
+	}
+	shards := append(append([]splitVolume{}, index.Volumes...), index.Parity...)
+	var bad []int
+	for i, v := range shards {
+		if !checkVolume(filepath.Join(dir, v.Name), v) {
+			bad = append(bad, i)
+		}
+	}
+	if len(bad) == 0 {
+		return nil
+	}
+	if len(bad) > len(index.Parity) {
+		return errorf(kindIntegrity, "%d volume(s) damaged, %d parity volume(s) can repair at most %d",
+			len(bad), len(index.Parity), len(index.Parity))
+	}
+	enc, err := reedsolomon.NewStream(len(index.Volumes), len(index.Parity))
+	if err != nil {
+		return err
+	}
+
+	valid := make([]io.Reader, len(shards))
+	fill := make([]io.Writer, len(shards))
+	var opened []*os.File
+	// repairs holds the .repair files not yet renamed over their volume,
+	// none of them is left behind when the repair fails.
+	repairs := make(map[string]bool)
+	defer func() {
+		for _, f := range opened {
+			_ = f.Close()
+		}
+		for path := range repairs {
+			_ = os.Remove(path)
+		}
+	}()
+	isBad := make(map[int]bool)
+	for _, i := range bad {
+		isBad[i] = true
+		path := filepath.Join(dir, shards[i].Name+".repair")
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		repairs[path] = true
+		opened = append(opened, f)
+		fill[i] = f
+	}
+	for i, v := range shards {
+		if isBad[i] {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, v.Name))
+		if err != nil {
+			return err
+		}
+		opened = append(opened, f)
+		valid[i] = padReader(f, v.Size, index.ShardSize)
+	}
+	fmt.Printf("Repairing %d volume(s) from parity\n", len(bad))
+	if err := enc.Reconstruct(valid, fill); err != nil {
+		return errorf(kindIntegrity, "repair volumes returns error: %v", err)
+	}
+
+	for _, i := range bad {
+		v := shards[i]
+		path := filepath.Join(dir, v.Name)
+		f := fill[i].(*os.File)
+		err := f.Truncate(v.Size)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil && !checkVolume(path+".repair", v) {
+			err = errorf(kindIntegrity, "repaired volume %s does not match its hash", v.Name)
+		}
+		if err == nil {
+			err = os.Rename(path+".repair", path)
+		}
+		if err != nil {
+			return err
+		}
+		delete(repairs, path+".repair")
+		logs.Info("volume repaired", "volume", v.Name)
+	}
+	fmt.Printf("Repaired %d volume(s)\n", len(bad))
+	return nil
+}
+
+// runRepair repairs and joins the split files of already downloaded
+// volume indexes.
+func runRepair(args []string) error {
+	if len(args) == 0 {
+		return errorf(kindUsage, "usage: repair <file%s>...", splitIndexExt)
+	}
+	var errs []error
+	for _, path := range args {
+		if err := joinVolumes(path); err != nil {
+			fmt.Printf("repair returns error: %v, onfile: %s\n", err, path)
+			errs = append(errs, err)
+		}
+	}
+	return combineErrors(errs, len(args))
+}
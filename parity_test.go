@@ -0,0 +1,145 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// splitFixture uploads size bytes of random data with --split-size 1M and
+// --parity parity to a fake server, and saves the uploaded volumes, parity
+// volumes and index into a new directory as a download would. It returns
+// that directory, the original content and the index path.
+func splitFixture(t *testing.T, size, parity int) (string, []byte, string) {
+	t.Helper()
+	fake, _ := withFakeCowtransfer(t)
+	savedSplit := splitBytes
+	t.Cleanup(func() { splitBytes = savedSplit })
+	runConfig.splitSize, runConfig.parity = "1M", parity
+	if err := setupSplit(); err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(content)
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := upload([]string{path}); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+
+	dir := t.TempDir()
+	for name, data := range fake.files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, content, filepath.Join(dir, "data.bin"+splitIndexExt)
+}
+
+func checkJoined(t *testing.T, dir string, content []byte) {
+	t.Helper()
+	got, err := os.ReadFile(filepath.Join(dir, "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(content) {
+		t.Fatalf("joined file differs from the original (%d of %d bytes)", len(got), len(content))
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Fatalf("left behind after join: %q", names)
+	}
+}
+
+func TestRepairVolumes(t *testing.T) {
+	const size = 3*1024*1024 + 1234
+	cases := []struct {
+		name    string
+		damage  map[string]string
+		wantErr errorKind
+	}{
+		{name: "intact"},
+		{name: "missing data volume", damage: map[string]string{"data.bin.002": "delete"}},
+		{name: "short last volume", damage: map[string]string{"data.bin.004": "truncate"}},
+		{name: "data and parity damaged", damage: map[string]string{
+			"data.bin.001": "corrupt", "data.bin.par.002": "delete",
+		}},
+		{name: "two data volumes", damage: map[string]string{
+			"data.bin.003": "corrupt", "data.bin.004": "delete",
+		}},
+		{name: "more damaged than parity", damage: map[string]string{
+			"data.bin.001": "delete", "data.bin.002": "corrupt", "data.bin.par.001": "delete",
+		}, wantErr: kindIntegrity},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, content, index := splitFixture(t, size, 2)
+			for name, how := range c.damage {
+				path := filepath.Join(dir, name)
+				var err error
+				switch how {
+				case "delete":
+					err = os.Remove(path)
+				case "truncate":
+					err = os.Truncate(path, 10)
+				case "corrupt":
+					var f *os.File
+					if f, err = os.OpenFile(path, os.O_WRONLY, 0); err == nil {
+						_, err = f.WriteAt([]byte("damaged"), 1000)
+						_ = f.Close()
+					}
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := joinVolumes(index)
+			if c.wantErr != 0 {
+				if kindOf(err) != c.wantErr {
+					t.Fatalf("err = %v (kind %d), want kind %d", err, kindOf(err), c.wantErr)
+				}
+				if matches, _ := filepath.Glob(filepath.Join(dir, "*.repair")); len(matches) != 0 {
+					t.Fatalf("repair files left behind: %q", matches)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("joinVolumes: %v", err)
+			}
+			checkJoined(t, dir, content)
+		})
+	}
+}
+
+func TestRepairVolumesCleanup(t *testing.T) {
+	dir, _, indexPath := splitFixture(t, 3*1024*1024, 2)
+	for _, name := range []string{"data.bin.001", "data.bin.002"} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the second repair file can not be created.
+	blocker := filepath.Join(dir, "data.bin.002.repair")
+	if err := os.MkdirAll(filepath.Join(blocker, "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	index, err := readSplitIndex(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repairVolumes(dir, index); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data.bin.001.repair")); !os.IsNotExist(err) {
+		t.Fatalf("data.bin.001.repair left behind (%v)", err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+const passwordEnv = "COWTRANSFER_PASSWORD"
+
+// fdPassword caches the password read from --password-fd, which can only
+// be read once but is needed for every link.
+var fdPassword struct {
+	once  sync.Once
+	value string
+	err   error
+}
+
+// presetPassword returns a password supplied without a prompt, either from
+// the environment or from the file descriptor given by --password-fd.
+func presetPassword() (string, error) {
+	if p := os.Getenv(passwordEnv); p != "" {
+		return p, nil
+	}
+	if runConfig.passwordFD < 0 {
+		return "", nil
+	}
+	fdPassword.once.Do(func() {
+		fdPassword.value, fdPassword.err = readPasswordFD(runConfig.passwordFD)
+	})
+	return fdPassword.value, fdPassword.err
+}
+
+func readPasswordFD(fd int) (string, error) {
+	f := os.Stdin
+	if fd != 0 {
+		if f = os.NewFile(uintptr(fd), "password-fd"); f == nil {
+			return "", fmt.Errorf("invalid password fd: %d", fd)
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+	}
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("read password from fd returns error: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func canPromptPassword() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+func promptPassword(fileID string) (string, error) {
+	fmt.Fprintf(os.Stderr, "Password for %s: ", fileID)
+	p, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("read password returns error: %v", err)
+	}
+	return strings.TrimSpace(string(p)), nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"testing"
+)
+
+func resetFDPassword() {
+	fdPassword.once = sync.Once{}
+	fdPassword.value, fdPassword.err = "", nil
+}
+
+func TestPresetPasswordFD(t *testing.T) {
+	t.Setenv(passwordEnv, "")
+	savedFD, savedStdin := runConfig.passwordFD, os.Stdin
+	defer func() {
+		runConfig.passwordFD, os.Stdin = savedFD, savedStdin
+	}()
+
+	for _, stdin := range []bool{false, true} {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.WriteString("s3cret\r\nrest\n")
+		_ = w.Close()
+		runConfig.passwordFD = int(r.Fd())
+		if stdin {
+			// fd 0 is a valid choice, reached through os.Stdin.
+			os.Stdin, runConfig.passwordFD = r, 0
+		}
+		resetFDPassword()
+
+		for i := 0; i < 2; i++ {
+			p, err := presetPassword()
+			if err != nil || p != "s3cret" {
+				t.Fatalf("stdin=%v call %d: presetPassword() = %q, %v", stdin, i, p, err)
+			}
+		}
+	}
+
+	runConfig.passwordFD = -1
+	resetFDPassword()
+	if p, err := presetPassword(); p != "" || err != nil {
+		t.Fatalf("unset fd: presetPassword() = %q, %v", p, err)
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cheggaaa/pb/v3"
+	"golang.org/x/term"
+)
+
+const (
+	redrawInterval = 200 * time.Millisecond
+	plainInterval  = 5 * time.Second
+	barNameWidth   = 24
+
+	fileBarTemplate  = `{{string . "prefix"}}{{counters . }} {{bar . }} {{percent . }} {{speed . }}{{string . "suffix"}}`
+	totalBarTemplate = `Total {{counters . }} {{bar . }} {{percent . }} {{speed . }} {{rtime . "ETA %s"}}{{string . "suffix"}}`
+)
+
+// fileBar is one transfer bar with the status of its parts.
+type fileBar struct {
+	bar     *pb.ProgressBar
+	name    string
+	parts   int64
+	done    int64
+	active  int64
+	retries int64
+}
+
+// progressView shows every bar of the run together with an overall bar for
+// the combined bytes, speed and ETA. On a terminal the block is redrawn in
+// place below the normal output, which is routed through the view so the
+// two do not mix; otherwise a plain status line is printed every
+// plainInterval.
+type progressView struct {
+	mu       sync.Mutex
+	once     sync.Once
+	tty      bool
+	term     *os.File
+	bars     []*fileBar
+	byBar    map[*pb.ProgressBar]*fileBar
+	total    *pb.ProgressBar
+	expected int64
+	doneSize int64
+	doneBars int
+	retries  int64
+	lines    int
+	last     string
+
+	stdout  *os.File
+	pipe    *os.File
+	copied  chan struct{}
+	logOut  io.Writer
+	stopped chan struct{}
+	exited  chan struct{}
+}
+
+// progress is the view shared by all transfers of the run.
+var progress = &progressView{byBar: make(map[*pb.ProgressBar]*fileBar)}
+
+func newStaticBar(tmpl string, total int64) *pb.ProgressBar {
+	bar := pb.New64(total)
+	bar.SetTemplateString(tmpl)
+	bar.Set(pb.Bytes, true)
+	bar.Set(pb.Static, true)
+	return bar.Start()
+}
+
+// start returns a new bar for a transfer of total bytes (0 if not known
+// yet), or nil in silent mode.
+func (v *progressView) start(name string, total int64) *pb.ProgressBar {
+	if runConfig.silentMode {
+		return nil
+	}
+	v.once.Do(v.run)
+	bar := newStaticBar(fileBarTemplate, total)
+	if w := len([]rune(name)); w > barNameWidth {
+		name = "..." + string([]rune(name)[w-barNameWidth+3:])
+	}
+	bar.Set("prefix", fmt.Sprintf("%-*s ", barNameWidth, name))
+	v.mu.Lock()
+	fb := &fileBar{bar: bar, name: name}
+	v.bars = append(v.bars, fb)
+	v.byBar[bar] = fb
+	v.mu.Unlock()
+	return bar
+}
+
+// finish removes bar from the live view and prints its final state once.
+func (v *progressView) finish(bar *pb.ProgressBar) {
+	if bar == nil {
+		return
+	}
+	bar.Finish()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fb, ok := v.byBar[bar]
+	if !ok {
+		return
+	}
+	delete(v.byBar, bar)
+	for i, b := range v.bars {
+		if b == fb {
+			v.bars = append(v.bars[:i], v.bars[i+1:]...)
+			break
+		}
+	}
+	v.doneSize += bar.Current()
+	v.doneBars++
+	v.updateStatus(fb)
+	if v.tty {
+		v.printAbove(bar.String() + "\n")
+	} else {
+		fmt.Fprintf(v.term, "[done] %s %s in %s\n", strings.TrimSpace(fb.name),
+			humanBytes(bar.Current()), time.Since(bar.StartTime()).Round(time.Second))
+	}
+}
+
+// expect announces bytes that will be transferred by bars not started yet,
+// so that the overall ETA covers the whole run.
+func (v *progressView) expect(n int64) {
+	v.mu.Lock()
+	v.expected += n
+	v.mu.Unlock()
+}
+
+// setParts records how many parts the transfer of bar is made of.
+func (v *progressView) setParts(bar *pb.ProgressBar, n int64) {
+	if fb := v.lookup(bar); fb != nil {
+		atomic.StoreInt64(&fb.parts, n)
+	}
+}
+
+func (v *progressView) partStart(bar *pb.ProgressBar) {
+	if fb := v.lookup(bar); fb != nil {
+		atomic.AddInt64(&fb.active, 1)
+	}
+}
+
+// partEnd records a finished part attempt; a failed attempt is a retry.
+func (v *progressView) partEnd(bar *pb.ProgressBar, err error) {
+	if err != nil {
+		v.retry(bar)
+	}
+	if fb := v.lookup(bar); fb != nil {
+		atomic.AddInt64(&fb.active, -1)
+		if err == nil {
+			atomic.AddInt64(&fb.done, 1)
+		}
+	}
+}
+
+// retry counts a retried request; bar may be nil when it is not tied to a
+// transfer bar.
+func (v *progressView) retry(bar *pb.ProgressBar) {
+	atomic.AddInt64(&v.retries, 1)
+	if fb := v.lookup(bar); fb != nil {
+		atomic.AddInt64(&fb.retries, 1)
+	}
+}
+
+func (v *progressView) lookup(bar *pb.ProgressBar) *fileBar {
+	if bar == nil {
+		return nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.byBar[bar]
+}
+
+func (v *progressView) run() {
+	v.term = os.Stderr
+	v.tty = term.IsTerminal(int(os.Stderr.Fd()))
+	v.total = newStaticBar(totalBarTemplate, 0)
+	v.stopped = make(chan struct{})
+	v.exited = make(chan struct{})
+	if v.tty {
+		v.capture()
+	}
+	go func() {
+		defer close(v.exited)
+		interval := plainInterval
+		if v.tty {
+			interval = redrawInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-v.stopped:
+				return
+			case <-ticker.C:
+				v.mu.Lock()
+				if v.tty {
+					v.redraw()
+				} else {
+					v.printPlain()
+				}
+				v.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// capture routes stdout (when it shares the terminal) and the log output
+// through the view, so that they are printed above the bars.
+func (v *progressView) capture() {
+	logs.sink.mu.Lock()
+	if logs.sink.out == os.Stderr {
+		v.logOut = logs.sink.out
+		logs.sink.out = writerFunc(func(p []byte) (int, error) {
+			v.mu.Lock()
+			v.printAbove(string(p))
+			v.mu.Unlock()
+			return len(p), nil
+		})
+	}
+	logs.sink.mu.Unlock()
+	if !term.IsTerminal(int(os.Stdout.Fd())) {
+		return
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	v.mu.Lock()
+	v.stdout, v.pipe, os.Stdout = os.Stdout, w, w
+	v.mu.Unlock()
+	v.copied = make(chan struct{})
+	go func() {
+		defer close(v.copied)
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadString('\n')
+			if line != "" {
+				v.mu.Lock()
+				v.printAbove(line)
+				v.mu.Unlock()
+			}
+			if err != nil {
+				_ = r.Close()
+				return
+			}
+		}
+	}()
+}
+
+// realStdout returns the file stdout pointed at before capture, for
+// terminal checks; output should still go to os.Stdout.
+func (v *progressView) realStdout() *os.File {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.stdout != nil {
+		return v.stdout
+	}
+	return os.Stdout
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// stop draws the final state and restores stdout and the log output.
+func (v *progressView) stop() {
+	if v.stopped == nil {
+		return
+	}
+	close(v.stopped)
+	<-v.exited
+	if v.pipe != nil {
+		_ = v.pipe.Close()
+		<-v.copied
+		os.Stdout = v.stdout
+	}
+	if v.logOut != nil {
+		logs.sink.mu.Lock()
+		logs.sink.out = v.logOut
+		logs.sink.mu.Unlock()
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.clear()
+	if v.doneBars+len(v.bars) < 2 {
+		return
+	}
+	v.updateTotal()
+	v.total.Finish()
+	if v.tty {
+		fmt.Fprintln(v.term, v.total.String())
+		return
+	}
+	fmt.Fprintf(v.term, "[total] %s in %s, %d file(s), %d retries\n", humanBytes(v.total.Current()),
+		time.Since(v.total.StartTime()).Round(time.Second), v.doneBars+len(v.bars), atomic.LoadInt64(&v.retries))
+}
+
+// printAbove prints text (whole lines) above the live bars. v.mu is held.
+func (v *progressView) printAbove(text string) {
+	v.clear()
+	out := io.Writer(v.term)
+	if v.stdout != nil {
+		out = v.stdout
+	}
+	_, _ = io.WriteString(out, text)
+	v.draw()
+}
+
+func (v *progressView) clear() {
+	if v.tty && v.lines > 0 {
+		fmt.Fprintf(v.term, "\033[%dA\r\033[J", v.lines)
+		v.lines = 0
+	}
+}
+
+func (v *progressView) redraw() {
+	v.clear()
+	v.draw()
+}
+
+func (v *progressView) draw() {
+	if !v.tty || v.stopped == nil {
+		return
+	}
+	width := 100
+	if w, _, err := term.GetSize(int(v.term.Fd())); err == nil && w > 0 {
+		width = w
+	}
+	var b strings.Builder
+	for _, fb := range v.bars {
+		v.updateStatus(fb)
+		fb.bar.SetWidth(width)
+		b.WriteString(fb.bar.String() + "\n")
+	}
+	if v.doneBars+len(v.bars) > 1 {
+		v.updateTotal()
+		v.total.SetWidth(width)
+		b.WriteString(v.total.String() + "\n")
+	}
+	_, _ = io.WriteString(v.term, b.String())
+	v.lines = strings.Count(b.String(), "\n")
+}
+
+func (v *progressView) printPlain() {
+	if len(v.bars) == 0 {
+		return
+	}
+	v.updateTotal()
+	line := fmt.Sprintf("[progress] %s/%s, %d active, %d done, %d retries", humanBytes(v.total.Current()),
+		humanBytes(v.total.Total()), len(v.bars), v.doneBars, atomic.LoadInt64(&v.retries))
+	if line == v.last {
+		return
+	}
+	v.last = line
+	// the total bar is only rendered for its speed and ETA.
+	v.total.SetWidth(200)
+	s := v.total.String()
+	if i := strings.LastIndex(s, "%"); i >= 0 {
+		line += ", " + strings.TrimSpace(s[i+1:])
+	}
+	fmt.Fprintln(v.term, line)
+}
+
+func (v *progressView) updateStatus(fb *fileBar) {
+	status := ""
+	if parts := atomic.LoadInt64(&fb.parts); parts > 0 {
+		status = fmt.Sprintf(" parts %d/%d", atomic.LoadInt64(&fb.done), parts)
+	}
+	if active := atomic.LoadInt64(&fb.active); active > 0 {
+		status += fmt.Sprintf(" workers %d", active)
+	}
+	if retries := atomic.LoadInt64(&fb.retries); retries > 0 {
+		status += fmt.Sprintf(" retries %d", retries)
+	}
+	fb.bar.Set("suffix", status)
+}
+
+func (v *progressView) updateTotal() {
+	current, total := v.doneSize, v.doneSize
+	active := int64(0)
+	for _, fb := range v.bars {
+		current += fb.bar.Current()
+		total += fb.bar.Total()
+		active += atomic.LoadInt64(&fb.active)
+	}
+	if v.expected > total {
+		total = v.expected
+	}
+	v.total.SetTotal(total)
+	v.total.SetCurrent(current)
+	status := fmt.Sprintf(" | %d active, %d done", len(v.bars), v.doneBars)
+	if active > 0 {
+		status += fmt.Sprintf(", %d workers", active)
+	}
+	if retries := atomic.LoadInt64(&v.retries); retries > 0 {
+		status += fmt.Sprintf(", %d retries", retries)
+	}
+	v.total.Set("suffix", status)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+	"rsc.io/qr"
+)
+
+// qrQuiet is the quiet zone, in modules, kept around the rendered code.
+const qrQuiet = 2
+
+var qrFiles struct {
+	sync.Mutex
+	count int
+}
+
+// showQRCode prints link as a QR code when stdout is a terminal and writes
+// it to --qr-file if set. Failures only cost the convenience, so they are
+// reported without failing the upload.
+func showQRCode(link string) {
+	if link == "" {
+		return
+	}
+	showTerm := !runConfig.silentMode && !runConfig.noQR && term.IsTerminal(int(progress.realStdout().Fd()))
+	if !showTerm && runConfig.qrFile == "" {
+		return
+	}
+	code, err := qr.Encode(link, qr.M)
+	if err != nil {
+		logs.Warn("encode qr code failed", "link", link, "error", err)
+		return
+	}
+	if showTerm {
+		renderQRCode(os.Stdout, code)
+	}
+	if runConfig.qrFile != "" {
+		path := nextQRFile(runConfig.qrFile)
+		if err := os.WriteFile(path, code.PNG(), 0644); err != nil {
+			fmt.Printf("write qr code returns error: %v\n", err)
+			return
+		}
+		fmt.Printf("QR Code: %s\n", path)
+	}
+}
+
+// nextQRFile numbers the PNG files of runs that create several transfers:
+// qr.png, qr-2.png, qr-3.png...
+func nextQRFile(path string) string {
+	qrFiles.Lock()
+	defer qrFiles.Unlock()
+	qrFiles.count++
+	if qrFiles.count == 1 {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(path, ext), qrFiles.count, ext)
+}
+
+// renderQRCode draws two rows of modules per line with Unicode half blocks.
+// Light modules are drawn in the foreground colour so that the code reads
+// correctly on the usual dark terminal background.
+func renderQRCode(w io.Writer, code *qr.Code) {
+	dark := func(x, y int) bool {
+		return x >= 0 && y >= 0 && x < code.Size && y < code.Size && code.Black(x, y)
+	}
+	var b strings.Builder
+	for y := -qrQuiet; y < code.Size+qrQuiet; y += 2 {
+		for x := -qrQuiet; x < code.Size+qrQuiet; x++ {
+			top, bottom := dark(x, y), dark(x, y+1)
+			switch {
+			case !top && !bottom:
+				b.WriteString("█")
+			case !top:
+				b.WriteString("▀")
+			case !bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteByte('\n')
+	}
+	_, _ = io.WriteString(w, b.String())
+}
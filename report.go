@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type reportEntry struct {
+	Path     string        `json:"path"`
+	Link     string        `json:"link,omitempty"`
+	Code     string        `json:"code,omitempty"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"-"`
+	Seconds  float64       `json:"seconds"`
+	Speed    float64       `json:"speed"`
+	Error    string        `json:"error,omitempty"`
+
+	start time.Time
+}
+
+type runReport struct {
+	mu      sync.Mutex
+	entries []*reportEntry
+}
+
+// report collects one entry per uploaded file for the end-of-run summary.
+var report = new(runReport)
+
+func (r *runReport) add(path string, size int64) *reportEntry {
+	e := &reportEntry{Path: path, Bytes: size, start: time.Now()}
+	r.mu.Lock()
+	r.entries = append(r.entries, e)
+	r.mu.Unlock()
+	return e
+}
+
+func (e *reportEntry) finish(err error) {
+	e.Duration = time.Since(e.start)
+	e.Seconds = e.Duration.Seconds()
+	if err != nil {
+		e.Error = err.Error()
+		return
+	}
+	if e.Duration > 0 {
+		e.Speed = float64(e.Bytes) / e.Duration.Seconds()
+	}
+}
+
+// flush prints the summary table for batch runs and writes --report and
+// --report-sidecar files.
+func (r *runReport) flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) == 0 {
+		return nil
+	}
+	if len(r.entries) > 1 {
+		r.print(os.Stdout)
+	}
+	if runConfig.reportSidecar {
+		for _, e := range r.entries {
+			if e.Error != "" {
+				continue
+			}
+			if err := writeReport(e.Path+".cowtransfer.json", []*reportEntry{e}); err != nil {
+				return err
+			}
+		}
+	}
+	if runConfig.report != "" {
+		return writeReport(runConfig.report, r.entries)
+	}
+	return nil
+}
+
+func (r *runReport) print(w io.Writer) {
+	failed := 0
+	fmt.Fprintf(w, "\nSummary:\n\n")
+	fmt.Fprintf(w, "%-8s%-12s%-10s%-12s%-10s%s\n", "Status", "Bytes", "Time", "Speed/s", "Code", "Path / Link")
+	for _, e := range r.entries {
+		status := "OK"
+		if e.Error != "" {
+			status = "FAILED"
+			failed++
+		}
+		fmt.Fprintf(w, "%-8s%-12d%-10s%-12s%-10s%s\n", status, e.Bytes,
+			e.Duration.Round(time.Second), humanBytes(int64(e.Speed)), e.Code, e.Path)
+		if e.Error != "" {
+			fmt.Fprintf(w, "%52s%s\n", "", e.Error)
+		} else {
+			fmt.Fprintf(w, "%52s%s\n", "", e.Link)
+		}
+	}
+	fmt.Fprintf(w, "\n%d file(s), %d succeeded, %d failed\n\n", len(r.entries), len(r.entries)-failed, failed)
+}
+
+func writeReport(path string, entries []*reportEntry) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("write report returns error: %v", err)
+	}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		cw := csv.NewWriter(f)
+		_ = cw.Write([]string{"path", "link", "code", "bytes", "duration", "speed", "error"})
+		for _, e := range entries {
+			_ = cw.Write([]string{
+				e.Path, e.Link, e.Code, strconv.FormatInt(e.Bytes, 10),
+				strconv.FormatFloat(e.Duration.Seconds(), 'f', 3, 64),
+				strconv.FormatFloat(e.Speed, 'f', 0, 64), e.Error,
+			})
+		}
+		cw.Flush()
+		err = cw.Error()
+	} else {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(entries)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -2,11 +2,12 @@ package main
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
-	"log"
 	"mime/multipart"
 	"net/http"
 	"strings"
@@ -31,85 +32,75 @@ func addTk(req *http.Request) {
 	req.Header.Set("authorization", runConfig.authCode)
 }
 
-func blockPut(postURL string, buf []byte, token string) (string, error) {
-	data := new(bytes.Buffer)
-	data.Write(buf)
+// partReader hashes a part while it is streamed as the request body. The
+// embedded SectionReader keeps Size available for the content length.
+type partReader struct {
+	*io.SectionReader
+	hash hash.Hash
+}
+
+func (p *partReader) Read(b []byte) (int, error) {
+	n, err := p.SectionReader.Read(b)
+	p.hash.Write(b[:n])
+	return n, err
+}
+
+func blockPut(l *logger, postURL string, part *io.SectionReader, token string) (string, error) {
+	data := &partReader{SectionReader: part, hash: md5.New()}
 	body, err := newRequest(postURL, data, token, "PUT")
 	if err != nil {
-		if runConfig.debugMode {
-			log.Printf("block upload failed (retrying)")
-		}
 		return "", err
 	}
 	var rBody upResp
 	if err := json.Unmarshal(body, &rBody); err != nil {
-		if runConfig.debugMode {
-			log.Printf("block upload failed (retrying)")
-		}
 		return "", err
 	}
 	if runConfig.hashCheck {
-		if hashBlock(buf) != rBody.MD5 {
-			if runConfig.debugMode {
-				log.Printf("block hashcheck failed (retrying)")
-			}
-			return "", fmt.Errorf("block hashcheck failed")
-		}
-		if runConfig.debugMode {
-			log.Printf("hash check: %s == %s", hashBlock(buf), rBody.MD5)
+		sum := fmt.Sprintf("%x", data.hash.Sum(nil))
+		if sum != rBody.MD5 {
+			return "", errorf(kindIntegrity, "block hashcheck failed: %s != %s", sum, rBody.MD5)
 		}
+		l.Debug("hash check passed", "md5", sum)
 	}
 	return rBody.Etag, nil
 }
 
 func newRequest(link string, postBody io.Reader, upToken string, action string) ([]byte, error) {
-	if runConfig.debugMode {
-		log.Printf("endpoint: %s", link)
-	}
-	client := http.Client{Timeout: time.Duration(runConfig.interval) * time.Second}
+	logs.Debug("request", "method", action, "endpoint", link)
 	req, err := http.NewRequest(action, link, postBody)
 	if err != nil {
-		if runConfig.debugMode {
-			log.Printf("build request returns error: %v", err)
-		}
+		logs.Debug("build request returns error", "error", err)
 		return nil, err
 	}
+	if sized, ok := postBody.(interface{ Size() int64 }); ok {
+		req.ContentLength = sized.Size()
+	}
 	req.Header.Set("referer", "https://cowtransfer.com/")
 	req.Header.Set("Content-Type", "application/octet-stream")
 	req.Header.Set("Authorization", "UpToken "+upToken)
-	if runConfig.debugMode {
-		log.Println(req.Header)
-	}
-	resp, err := client.Do(req)
+	logs.Debug("request headers", "headers", req.Header)
+	resp, err := apiClient.Do(req)
 	if err != nil {
-		if runConfig.debugMode {
-			log.Printf("do request returns error: %v", err)
-		}
-		return nil, err
+		logs.Debug("do request returns error", "error", err)
+		return nil, wrapError(kindNetwork, err)
 	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		if runConfig.debugMode {
-			log.Printf("read response returns: %v", err)
-		}
-		return nil, err
+		logs.Debug("read response returns error", "error", err)
+		return nil, wrapError(kindNetwork, err)
 	}
 	_ = resp.Body.Close()
-	if runConfig.debugMode {
-		if len(body) < 1024 {
-			log.Printf("returns: %v", string(body))
-		}
+	if len(body) < 1024 {
+		logs.Debug("response", "status", resp.StatusCode, "body", body)
+	}
+	if resp.StatusCode >= 400 {
+		return nil, statusError(resp)
 	}
 	return body, nil
 }
 
 func newMultipartRequest(url string, params map[string]string, retry int) ([]byte, error) {
-	if runConfig.debugMode {
-		log.Printf("retrying: %v", retry)
-		log.Printf("postBody: %v", params)
-		log.Printf("endpoint: %s", url)
-	}
-	client := http.Client{Timeout: time.Duration(runConfig.interval) * time.Second}
+	logs.Debug("request", "method", "POST", "endpoint", url, "retry", retry, "params", params)
 	buf := &bytes.Buffer{}
 	writer := multipart.NewWriter(buf)
 	for key, val := range params {
@@ -118,9 +109,7 @@ func newMultipartRequest(url string, params map[string]string, retry int) ([]byt
 	_ = writer.Close()
 	req, err := http.NewRequest("POST", url, buf)
 	if err != nil {
-		if runConfig.debugMode {
-			log.Printf("build request returns error: %v", err)
-		}
+		logs.Debug("build request returns error", "error", err)
 		if retry > 3 {
 			return nil, err
 		}
@@ -129,41 +118,31 @@ func newMultipartRequest(url string, params map[string]string, retry int) ([]byt
 	req.Header.Set("content-type", fmt.Sprintf("multipart/form-data;boundary=%s", writer.Boundary()))
 	req.Header.Set("referer", "https://cowtransfer.com/")
 	addTk(req)
-	if runConfig.debugMode {
-		log.Println(req.Header)
-	}
-	resp, err := client.Do(addHeaders(req))
+	logs.Debug("request headers", "headers", req.Header)
+	resp, err := apiClient.Do(addHeaders(req))
 	if err != nil {
-		if runConfig.debugMode {
-			log.Printf("do request returns error: %v", err)
-		}
+		logs.Debug("do request returns error", "error", err)
 		if retry > 3 {
-			return nil, err
+			return nil, wrapError(kindNetwork, err)
 		}
 		return newMultipartRequest(url, params, retry+1)
 	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		if runConfig.debugMode {
-			log.Printf("read response returns: %v", err)
-		}
+		logs.Debug("read response returns error", "error", err)
 		if retry > 3 {
 			return nil, err
 		}
 		return newMultipartRequest(url, params, retry+1)
 	}
 	_ = resp.Body.Close()
-	if runConfig.debugMode {
-		log.Printf("returns: %v", string(body))
-	}
+	logs.Debug("response", "status", resp.StatusCode, "body", body)
 	if s := resp.Header.Values("Set-Cookie"); len(s) != 0 && runConfig.token == "" {
 		for _, v := range s {
 			ck := strings.Split(v, ";")
 			runConfig.token += ck[0] + ";"
 		}
-		if runConfig.debugMode {
-			log.Printf("cookies set to: %v", runConfig.token)
-		}
+		logs.Debug("cookies set", "cookie", runConfig.token)
 	}
 
 	return body, nil
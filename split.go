@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// splitIndexExt names the index uploaded next to the volumes of a split
+// file: big.iso is sent as big.iso.001, big.iso.002, ... and big.iso.cowsplit.
+const (
+	splitIndexExt  = ".cowsplit"
+	splitIndexVer  = 1
+	minVolumeDigit = 3
+)
+
+// splitBytes is the parsed --split-size, 0 when files are not split.
+var splitBytes int64
+
+// splitIndex is the JSON content of a .cowsplit file. Volumes are listed in
+// the order they are joined; hashes are hex encoded SHA-256. The parity
+// fields are only set with --parity, see parity.go for their format.
+type splitIndex struct {
+	Version   int           `json:"version"`
+	Name      string        `json:"name"`
+	Size      int64         `json:"size"`
+	SHA256    string        `json:"sha256"`
+	Volumes   []splitVolume `json:"volumes"`
+	Scheme    string        `json:"scheme,omitempty"`
+	ShardSize int64         `json:"shard_size,omitempty"`
+	Parity    []splitVolume `json:"parity,omitempty"`
+}
+
+type splitVolume struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// volumeInfo describes a remote file that has no local file of its own.
+type volumeInfo struct {
+	name string
+	size int64
+}
+
+func (v volumeInfo) Name() string       { return v.name }
+func (v volumeInfo) Size() int64        { return v.size }
+func (v volumeInfo) Mode() os.FileMode  { return 0644 }
+func (v volumeInfo) ModTime() time.Time { return time.Now() }
+func (v volumeInfo) IsDir() bool        { return false }
+func (v volumeInfo) Sys() interface{}   { return nil }
+
+func setupSplit() error {
+	if runConfig.parity < 0 || runConfig.parity > 0 && runConfig.splitSize == "" {
+		return fmt.Errorf("--parity needs a positive count and --split-size")
+	}
+	if runConfig.splitSize == "" {
+		return nil
+	}
+	size, err := parseSize(runConfig.splitSize)
+	if err != nil {
+		return fmt.Errorf("invalid split size: %v", err)
+	}
+	if size < blockAlign {
+		return fmt.Errorf("invalid split size: must be at least 1M")
+	}
+	splitBytes = size
+	return nil
+}
+
+// parseSize parses a byte count with an optional binary K, M, G or T suffix,
+// e.g. 1500M or 2G.
+func parseSize(s string) (int64, error) {
+	v := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), "I")
+	shift := 0
+	if n := len(v); n > 0 {
+		if i := strings.IndexByte("KMGT", v[n-1]); i >= 0 {
+			shift = 10 * (i + 1)
+			v = v[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 || n > (1<<62)>>shift {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n << shift, nil
+}
+
+func volumeName(name string, i, count int) string {
+	digits := len(strconv.Itoa(count))
+	if digits < minVolumeDigit {
+		digits = minVolumeDigit
+	}
+	return fmt.Sprintf("%s.%0*d", name, digits, i)
+}
+
+// uploadVolumes sends file as volumes of --split-size bytes followed by
+// their index, and returns the MD5 of the whole file for the history.
+func uploadVolumes(l *logger, file io.ReaderAt, info os.FileInfo, baseConf *prepareSendResp) (string, error) {
+	count := int((info.Size() + splitBytes - 1) / splitBytes)
+	index := &splitIndex{Version: splitIndexVer, Name: info.Name(), Size: info.Size()}
+	l.Debug("hashing volumes", "volumes", count, "split", splitBytes)
+	whole, sum := sha256.New(), md5.New()
+	for i := 0; i < count; i++ {
+		offset := int64(i) * splitBytes
+		size := splitBytes
+		if offset+size > info.Size() {
+			size = info.Size() - offset
+		}
+		vh := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(whole, sum, vh), io.NewSectionReader(file, offset, size)); err != nil {
+			return "", fmt.Errorf("hash volume returns error: %w", err)
+		}
+		index.Volumes = append(index.Volumes, splitVolume{
+			Name:   volumeName(info.Name(), i+1, count),
+			Size:   size,
+			SHA256: hexSum(vh),
+		})
+	}
+	index.SHA256 = hexSum(whole)
+	fmt.Printf("Split into %d volume(s) of up to %s\n", count, humanBytes(splitBytes))
+
+	for i, v := range index.Volumes {
+		fmt.Printf("Volume: %s\n", v.Name)
+		r := io.NewSectionReader(file, int64(i)*splitBytes, v.Size)
+		if err := uploadSection(l.With("volume", v.Name), r, volumeInfo{v.Name, v.Size}, baseConf); err != nil {
+			return "", err
+		}
+	}
+	if runConfig.parity > 0 {
+		if err := uploadParity(l, file, index, baseConf); err != nil {
+			return "", err
+		}
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	name := info.Name() + splitIndexExt
+	fmt.Printf("Volume index: %s\n", name)
+	if err := uploadSection(l.With("volume", name), bytes.NewReader(data), volumeInfo{name, int64(len(data))}, baseConf); err != nil {
+		return "", err
+	}
+	return hexSum(sum), nil
+}
+
+func hexSum(h hash.Hash) string {
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func readSplitIndex(path string) (*splitIndex, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	index := new(splitIndex)
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, errorf(kindIntegrity, "volume index %s is corrupt: %v", path, err)
+	}
+	if index.Version != splitIndexVer {
+		return nil, errorf(kindGeneral, "volume index %s has unsupported version %d", path, index.Version)
+	}
+	names := []string{index.Name}
+	for _, v := range append(index.Volumes, index.Parity...) {
+		names = append(names, v.Name)
+	}
+	for _, name := range names {
+		if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+			return nil, errorf(kindIntegrity, "volume index %s has unsafe file name %q", path, name)
+		}
+	}
+	return index, nil
+}
+
+// joinVolumes rebuilds the file described by the index at path from the
+// volumes next to it, verifying every volume and the result and repairing
+// them from parity volumes if needed. The volumes and the index are removed
+// once the joined file checks out.
+func joinVolumes(path string) error {
+	index, err := readSplitIndex(path)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if err := repairVolumes(dir, index); err != nil {
+		return err
+	}
+	target := filepath.Join(dir, index.Name)
+	l := logs.With("file", target)
+	l.Debug("joining volumes", "volumes", len(index.Volumes))
+
+	tmp := target + ".joining"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	whole := sha256.New()
+	err = func() error {
+		for _, v := range index.Volumes {
+			if err := appendVolume(io.MultiWriter(out, whole), filepath.Join(dir, v.Name), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && hexSum(whole) != index.SHA256 {
+		err = errorf(kindIntegrity, "joined file %s does not match its index hash", target)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		return err
+	}
+	for _, v := range append(index.Volumes, index.Parity...) {
+		_ = os.Remove(filepath.Join(dir, v.Name))
+	}
+	_ = os.Remove(path)
+	fmt.Printf("Joined %d volume(s) into %s\n", len(index.Volumes), target)
+	return nil
+}
+
+func appendVolume(w io.Writer, path string, v splitVolume) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errorf(kindIntegrity, "volume %s is missing: %v", v.Name, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	vh := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, vh), f)
+	if err != nil {
+		return err
+	}
+	if n != v.Size {
+		return errorf(kindIntegrity, "volume %s is corrupt: size %d, want %d", v.Name, n, v.Size)
+	}
+	if hexSum(vh) != v.SHA256 {
+		return errorf(kindIntegrity, "volume %s is corrupt: hash mismatch", v.Name)
+	}
+	return nil
+}
+
+// joinSplitFiles joins every split file of a finished download whose index
+// was saved to disk.
+func joinSplitFiles(items []downloadDetailsBlock) []error {
+	var errs []error
+	if isStdout(runConfig.prefix) {
+		return nil
+	}
+	for _, item := range items {
+		if !strings.HasSuffix(item.FileName, splitIndexExt) {
+			continue
+		}
+		path, err := destinationPath(item)
+		if err != nil || !isFile(path) {
+			continue
+		}
+		if err := joinVolumes(path); err != nil {
+			fmt.Printf("join volumes returns error: %v, onfile: %s\n", err, item.FileName)
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
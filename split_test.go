@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	cases := []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{in: "1024", want: 1024},
+		{in: "1500M", want: 1500 << 20},
+		{in: "2G", want: 2 << 30},
+		{in: "2gib", want: 2 << 30},
+		{in: " 4KB ", want: 4 << 10},
+		{in: "1T", want: 1 << 40},
+		{in: "", err: true},
+		{in: "G", err: true},
+		{in: "-1M", err: true},
+		{in: "1.5G", err: true},
+		{in: "99999999999T", err: true},
+	}
+	for _, c := range cases {
+		got, err := parseSize(c.in)
+		if (err != nil) != c.err || got != c.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d (error %v)", c.in, got, err, c.want, c.err)
+		}
+	}
+}
+
+func TestVolumeName(t *testing.T) {
+	if got := volumeName("a.iso", 2, 12); got != "a.iso.002" {
+		t.Errorf("volumeName = %q", got)
+	}
+	if got := volumeName("a.iso", 7, 1200); got != "a.iso.0007" {
+		t.Errorf("volumeName = %q", got)
+	}
+}
+
+func TestJoinVolumes(t *testing.T) {
+	const size = 2*1024*1024 + 77
+	t.Run("round trip", func(t *testing.T) {
+		dir, content, index := splitFixture(t, size, 0)
+		idx, err := readSplitIndex(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(idx.Volumes) != 3 || idx.Volumes[2].Size != 77 || idx.Size != size {
+			t.Fatalf("unexpected index %+v", idx)
+		}
+		if err := joinVolumes(index); err != nil {
+			t.Fatalf("joinVolumes: %v", err)
+		}
+		checkJoined(t, dir, content)
+	})
+	t.Run("missing volume", func(t *testing.T) {
+		dir, _, index := splitFixture(t, size, 0)
+		_ = os.Remove(filepath.Join(dir, "data.bin.002"))
+		err := joinVolumes(index)
+		if kindOf(err) != kindIntegrity {
+			t.Fatalf("err = %v, want an integrity error", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "data.bin")); !os.IsNotExist(err) {
+			t.Fatal("joined file written despite a missing volume")
+		}
+		if _, err := os.Stat(filepath.Join(dir, "data.bin.001")); err != nil {
+			t.Fatal("volumes removed after a failed join")
+		}
+	})
+	t.Run("wrong hash", func(t *testing.T) {
+		dir, _, index := splitFixture(t, size, 0)
+		f, err := os.OpenFile(filepath.Join(dir, "data.bin.001"), os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = f.WriteAt([]byte("x"), 0)
+		_ = f.Close()
+		if err := joinVolumes(index); kindOf(err) != kindIntegrity {
+			t.Fatalf("err = %v, want an integrity error", err)
+		}
+		if matches, _ := filepath.Glob(filepath.Join(dir, "*.joining")); len(matches) != 0 {
+			t.Fatalf("temporary files left behind: %q", matches)
+		}
+	})
+	t.Run("wrong whole hash", func(t *testing.T) {
+		_, _, index := splitFixture(t, size, 0)
+		rewriteIndex(t, index, func(idx *splitIndex) { idx.SHA256 = "00" })
+		if err := joinVolumes(index); kindOf(err) != kindIntegrity {
+			t.Fatalf("err = %v, want an integrity error", err)
+		}
+	})
+}
+
+func rewriteIndex(t *testing.T, path string, change func(*splitIndex)) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := new(splitIndex)
+	if err := json.Unmarshal(data, idx); err != nil {
+		t.Fatal(err)
+	}
+	change(idx)
+	if data, err = json.Marshal(idx); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadSplitIndexUnsafeNames(t *testing.T) {
+	names := []string{"../evil", "a/../../evil", "sub/evil", "/etc/passwd", "..", ".", ""}
+	for _, name := range names {
+		for _, field := range []string{"name", "volume", "parity"} {
+			path := filepath.Join(t.TempDir(), "data.bin"+splitIndexExt)
+			idx := splitIndex{
+				Version: splitIndexVer,
+				Name:    "data.bin",
+				Volumes: []splitVolume{{Name: "data.bin.001"}},
+				Parity:  []splitVolume{{Name: "data.bin.par.001"}},
+			}
+			switch field {
+			case "name":
+				idx.Name = name
+			case "volume":
+				idx.Volumes[0].Name = name
+			case "parity":
+				idx.Parity[0].Name = name
+			}
+			data, _ := json.Marshal(idx)
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readSplitIndex(path); kindOf(err) != kindIntegrity {
+				t.Errorf("%s %q: err = %v, want an integrity error", field, name, err)
+			}
+			if err := joinVolumes(path); err == nil {
+				t.Errorf("%s %q: joinVolumes accepted the index", field, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cheggaaa/pb/v3"
+)
+
+const streamChunk = 4 * 1024 * 1024
+
+// stdout is where streamed downloads are written. When streaming, os.Stdout
+// is pointed at stderr so that status messages do not mix with file data.
+var stdout io.Writer = os.Stdout
+
+func isStdout(prefix string) bool {
+	return prefix == "-"
+}
+
+func redirectStdout() {
+	stdout = os.Stdout
+	os.Stdout = os.Stderr
+}
+
+type streamChunkResult struct {
+	data []byte
+	err  error
+}
+
+// streamFile writes the remote file to w strictly in order. Chunks are fetched
+// by workerCount() range workers, but at most 2*workers chunks are in
+// flight or waiting for reassembly, which bounds memory usage.
+func streamFile(w io.Writer, url string, bar *pb.ProgressBar) error {
+	length, ranged, err := probeFile(url)
+	if err != nil {
+		return err
+	}
+	if !runConfig.silentMode && bar != nil {
+		bar.SetTotal(length)
+	}
+	workers := workerCount()
+	if !ranged || workers <= 1 || length <= streamChunk {
+		return streamWhole(w, url, length, bar)
+	}
+
+	tune := newTuner()
+	defer tune.close()
+	chunks := (length + streamChunk - 1) / streamChunk
+	window := 2 * workers
+	slots := make([]chan streamChunkResult, chunks)
+	for i := range slots {
+		slots[i] = make(chan streamChunkResult, 1)
+	}
+	jobs := make(chan int64)
+	tokens := make(chan struct{}, window)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(jobs)
+		for i := int64(0); i < chunks; i++ {
+			select {
+			case tokens <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for i := 0; i < workers; i++ {
+		go func() {
+			for idx := range jobs {
+				start := idx * streamChunk
+				end := start + streamChunk
+				if end > length {
+					end = length
+				}
+				data, err := fetchChunk(tune, url, start, end)
+				slots[idx] <- streamChunkResult{data: data, err: err}
+			}
+		}()
+	}
+
+	for i := int64(0); i < chunks; i++ {
+		res := <-slots[i]
+		if res.err != nil {
+			return fmt.Errorf("fetch chunk %d returns error: %w", i, res.err)
+		}
+		if _, err := w.Write(res.data); err != nil {
+			return err
+		}
+		if !runConfig.silentMode && bar != nil {
+			bar.Add(len(res.data))
+		}
+		<-tokens
+	}
+	return nil
+}
+
+func fetchChunk(t *tuner, url string, start, end int64) ([]byte, error) {
+	var err error
+	for retry := 0; retry < maxRetries; retry++ {
+		if retry > 0 {
+			time.Sleep(retryDelay(retry))
+		}
+		var data []byte
+		t.acquire()
+		data, err = fetchRange(url, start, end)
+		t.add(int64(len(data)))
+		t.release(err)
+		if err == nil || !retryable(err) {
+			return data, err
+		}
+		logs.Debug("chunk failed (retrying)", "start", start, "end", end, "error", err)
+		progress.retry(nil)
+	}
+	return nil, err
+}
+
+// downloadChunks fills out with fixed-size ranges fetched by a pool of
+// workers whose active count is steered by the --auto tuner.
+func downloadChunks(out *os.File, url string, length int64, bar *pb.ProgressBar) error {
+	tune := newTuner()
+	defer tune.close()
+	chunks := (length + streamChunk - 1) / streamChunk
+	jobs := make(chan int64)
+	failed := make(chan error, 1)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < workerCount(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				start := idx * streamChunk
+				end := start + streamChunk
+				if end > length {
+					end = length
+				}
+				data, err := fetchChunk(tune, url, start, end)
+				if err == nil {
+					_, err = out.WriteAt(data, start)
+				}
+				if err != nil {
+					select {
+					case failed <- fmt.Errorf("chunk %d returns error: %w", idx, err):
+					default:
+					}
+					continue
+				}
+				if !runConfig.silentMode && bar != nil {
+					bar.Add(len(data))
+				}
+			}
+		}()
+	}
+	var err error
+Feed:
+	for i := int64(0); i < chunks; i++ {
+		select {
+		case jobs <- i:
+		case err = <-failed:
+			break Feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err == nil {
+		select {
+		case err = <-failed:
+		default:
+		}
+	}
+	return err
+}
+
+func fetchRange(url string, start, end int64) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	addHeaders(req)
+	resp, err := doDownload(req)
+	if err != nil {
+		return nil, wrapError(kindNetwork, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, statusError(resp)
+	}
+	data := make([]byte, end-start)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, wrapError(kindNetwork, err)
+	}
+	return data, nil
+}
+
+func streamWhole(w io.Writer, url string, length int64, bar *pb.ProgressBar) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	addHeaders(req)
+	resp, err := doDownload(req)
+	if err != nil {
+		return wrapError(kindNetwork, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode >= 400 {
+		return statusError(resp)
+	}
+	var r io.Reader = resp.Body
+	if !runConfig.silentMode && bar != nil {
+		r = bar.NewProxyReader(r)
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	if n != length {
+		return errorf(kindIntegrity, "short read: %d of %d bytes", n, length)
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is written by streamFile and read by the test server.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Len()
+}
+
+func TestStreamFileOrder(t *testing.T) {
+	saved := *runConfig
+	defer func() { *runConfig = saved }()
+	runConfig.parallel = 3
+	runConfig.autoMode = false
+	window := int64(2 * runConfig.parallel)
+
+	const chunks = 10
+	content := make([]byte, chunks*streamChunk-1234)
+	rand.New(rand.NewSource(1)).Read(content)
+	out := new(lockedBuffer)
+
+	var mu sync.Mutex
+	var requested []int64
+	highest := int64(-1)
+	windowFull := make(chan struct{})
+	srv := rangeServer(t, content, func(w http.ResponseWriter, r *http.Request) bool {
+		var start, end int64
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil {
+			t.Errorf("bad range %q", r.Header.Get("Range"))
+			return false
+		}
+		idx := start / streamChunk
+		written := int64(out.Len()) / streamChunk
+		mu.Lock()
+		requested = append(requested, idx)
+		if idx >= written+window {
+			t.Errorf("chunk %d requested with only %d chunks written, window %d", idx, written, window)
+		}
+		if idx > highest {
+			highest = idx
+			if highest == window-1 {
+				close(windowFull)
+			}
+		}
+		mu.Unlock()
+
+		if idx == 0 {
+			// the first chunk is answered last of the window, so that the
+			// others complete out of order and must wait for it.
+			select {
+			case <-windowFull:
+			case <-time.After(5 * time.Second):
+				t.Error("window never filled while the first chunk was held")
+			}
+			time.Sleep(100 * time.Millisecond)
+			mu.Lock()
+			if highest != window-1 {
+				t.Errorf("chunk %d requested while chunk 0 was outstanding", highest)
+			}
+			mu.Unlock()
+		} else if idx%3 == 1 {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return false
+	})
+
+	if err := streamFile(out, srv.URL, nil); err != nil {
+		t.Fatalf("streamFile: %v", err)
+	}
+	if !bytes.Equal(out.buf.Bytes(), content) {
+		t.Fatalf("streamed %d bytes, content differs from the %d byte file", out.buf.Len(), len(content))
+	}
+	if len(requested) != chunks {
+		t.Fatalf("requested chunks %v, want each of %d once", requested, chunks)
+	}
+}
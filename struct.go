@@ -1,20 +1,54 @@
 package main
 
 type mainConfig struct {
-	token      string
-	parallel   int
-	interval   int
-	prefix     string
-	debugMode  bool
-	singleMode bool
-	version    bool
-	keepMode   bool
-	authCode   string
-	blockSize  int
-	hashCheck  bool
-	passCode   string
-	silentMode bool
-	validDays  int
+	token          string
+	parallel       int
+	interval       int
+	prefix         string
+	debugMode      bool
+	singleMode     bool
+	version        bool
+	keepMode       bool
+	authCode       string
+	blockSize      int
+	hashCheck      bool
+	passCode       string
+	silentMode     bool
+	validDays      int
+	historyDB      string
+	noHistory      bool
+	passwordFD     int
+	extract        bool
+	keepArchive    bool
+	autoMode       bool
+	proxy          string
+	noProxy        string
+	caCert         string
+	clientCert     string
+	clientKey      string
+	insecure       bool
+	logLevel       string
+	logFormat      string
+	logFile        string
+	report         string
+	reportSidecar  bool
+	excludes       stringList
+	includes       stringList
+	excludeFrom    stringList
+	followSymlinks bool
+	skipHidden     bool
+	dryRun         bool
+	settle         int
+	moveTo         string
+	deleteAfter    bool
+	onComplete     string
+	webhook        string
+	noQR           bool
+	qrFile         string
+	splitSize      string
+	parity         int
+	compress       string
+	decompress     bool
 }
 
 type uploadResult struct {
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// transport is shared by every request made by the program, API calls,
+// Qiniu block uploads and downloads alike.
+var (
+	transport = http.DefaultTransport.(*http.Transport).Clone()
+
+	// apiClient is used for API and upload requests, limited by --timeout.
+	apiClient = &http.Client{Transport: transport}
+	// downloadClient is used for file bodies, which may take arbitrarily
+	// long; stalls are caught by the idle watchdog in doDownload instead.
+	downloadClient = &http.Client{Transport: transport}
+)
+
+func setupTransport() error {
+	proxy, err := proxyFunc(runConfig.proxy, runConfig.noProxy)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := tlsClientConfig()
+	if err != nil {
+		return err
+	}
+	transport.TLSClientConfig = tlsConfig
+	timeout := time.Duration(runConfig.interval) * time.Second
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	transport.Proxy = proxy
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = timeout
+	transport.ResponseHeaderTimeout = timeout
+	transport.MaxIdleConnsPerHost = workerCount() + 2
+	transport.MaxIdleConns = 4 * transport.MaxIdleConnsPerHost
+	apiClient.Timeout = timeout
+	return nil
+}
+
+// tlsClientConfig builds the TLS settings from --ca-cert, --client-cert,
+// --client-key and --insecure. The CA bundle is added to the system pool
+// rather than replacing it.
+func tlsClientConfig() (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if runConfig.caCert != "" {
+		pem, err := ioutil.ReadFile(runConfig.caCert)
+		if err != nil {
+			return nil, fmt.Errorf("read ca cert returns error: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", runConfig.caCert)
+		}
+		conf.RootCAs = pool
+	}
+	if runConfig.clientCert != "" || runConfig.clientKey != "" {
+		if runConfig.clientCert == "" || runConfig.clientKey == "" {
+			return nil, fmt.Errorf("--client-cert and --client-key must be used together")
+		}
+		cert, err := tls.LoadX509KeyPair(runConfig.clientCert, runConfig.clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("load client cert returns error: %v", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if runConfig.insecure {
+		fmt.Fprintf(os.Stderr, "WARNING: --insecure disables TLS certificate verification, "+
+			"transfers and credentials can be intercepted.\n")
+		conf.InsecureSkipVerify = true
+	}
+	return conf, nil
+}
+
+// doDownload sends req with the download client and aborts the body once
+// no data arrived for --timeout seconds.
+func doDownload(req *http.Request) (*http.Response, error) {
+	if runConfig.interval <= 0 {
+		return downloadClient.Do(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := downloadClient.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = newIdleReader(resp.Body, cancel, time.Duration(runConfig.interval)*time.Second)
+	return resp, nil
+}
+
+// idleReader aborts the request once a single body.Read blocks for longer
+// than timeout. The watchdog only runs while Read is blocked, so a consumer
+// that is slow between reads is not mistaken for a stalled connection.
+type idleReader struct {
+	body    io.ReadCloser
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	timeout time.Duration
+	stalled int32
+}
+
+func newIdleReader(body io.ReadCloser, cancel context.CancelFunc, timeout time.Duration) *idleReader {
+	r := &idleReader{body: body, cancel: cancel, timeout: timeout}
+	r.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&r.stalled, 1)
+		cancel()
+	})
+	r.timer.Stop()
+	return r
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&r.stalled) == 1 {
+		return 0, r.stallError()
+	}
+	r.timer.Reset(r.timeout)
+	n, err := r.body.Read(p)
+	if !r.timer.Stop() && atomic.LoadInt32(&r.stalled) == 1 {
+		return n, r.stallError()
+	}
+	return n, err
+}
+
+func (r *idleReader) stallError() error {
+	return errorf(kindNetwork, "download stalled: no data for %s", r.timeout)
+}
+
+func (r *idleReader) Close() error {
+	r.timer.Stop()
+	err := r.body.Close()
+	r.cancel()
+	return err
+}
+
+// envProxy picks the proxy from HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+var envProxy = http.ProxyFromEnvironment
+
+// proxyFunc returns the proxy selection for --proxy, falling back to the
+// environment when it is empty. Hosts matching --no-proxy are always
+// connected to directly, whichever proxy would be used otherwise.
+func proxyFunc(proxy, noProxy string) (func(*http.Request) (*url.URL, error), error) {
+	var rules []string
+	for _, v := range strings.Split(noProxy, ",") {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			rules = append(rules, v)
+		}
+	}
+	next := envProxy
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %v", proxy, err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q (http, https, socks5)", u.Scheme)
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q: missing host", proxy)
+		}
+		next = http.ProxyURL(u)
+	}
+	if len(rules) == 0 {
+		return next, nil
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL.Hostname(), rules) {
+			return nil, nil
+		}
+		return next(req)
+	}, nil
+}
+
+func bypassProxy(host string, rules []string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, rule := range rules {
+		if rule == "*" {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(rule); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		rule = strings.TrimPrefix(rule, ".")
+		if host == rule || strings.HasSuffix(host, "."+rule) {
+			return true
+		}
+	}
+	return false
+}
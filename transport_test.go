@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type blockingBody struct {
+	ctx context.Context
+}
+
+func (b blockingBody) Read(p []byte) (int, error) {
+	<-b.ctx.Done()
+	return 0, b.ctx.Err()
+}
+
+func (b blockingBody) Close() error { return nil }
+
+func TestIdleReaderSlowConsumer(t *testing.T) {
+	_, cancel := context.WithCancel(context.Background())
+	r := newIdleReader(io.NopCloser(strings.NewReader("abcdef")), cancel, 20*time.Millisecond)
+	defer r.Close()
+	buf := make([]byte, 2)
+	for i := 0; i < 3; i++ {
+		// time spent by the consumer between reads must not count.
+		time.Sleep(60 * time.Millisecond)
+		if _, err := r.Read(buf); err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+	}
+}
+
+func TestIdleReaderStall(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := newIdleReader(blockingBody{ctx}, cancel, 20*time.Millisecond)
+	defer r.Close()
+	_, err := r.Read(make([]byte, 1))
+	if err == nil || !strings.Contains(err.Error(), "stalled") {
+		t.Fatalf("err = %v, want a stall", err)
+	}
+	if kindOf(err) != kindNetwork {
+		t.Fatalf("kind = %d, want %d", kindOf(err), kindNetwork)
+	}
+}
+
+func TestProxyFuncNoProxy(t *testing.T) {
+	env, _ := url.Parse("http://env-proxy:3128")
+	saved := envProxy
+	envProxy = http.ProxyURL(env)
+	defer func() { envProxy = saved }()
+
+	cases := []struct {
+		proxy, noProxy, target string
+		want                   string
+	}{
+		{"", "", "https://cowtransfer.com/api", "http://env-proxy:3128"},
+		{"", "cowtransfer.com", "https://cowtransfer.com/api", ""},
+		{"", "cowtransfer.com", "https://upload.qiniup.com/buckets", "http://env-proxy:3128"},
+		{"", ".qiniup.com, 10.0.0.0/8", "https://upload.qiniup.com/buckets", ""},
+		{"", "10.0.0.0/8", "http://10.1.2.3/file", ""},
+		{"", "*", "https://cowtransfer.com/api", ""},
+		{"socks5://flag-proxy:1080", "", "https://cowtransfer.com/api", "socks5://flag-proxy:1080"},
+		{"socks5://flag-proxy:1080", "cowtransfer.com", "https://cowtransfer.com/api", ""},
+		{"socks5://flag-proxy:1080", "cowtransfer.com", "https://c-t.work/s/x", "socks5://flag-proxy:1080"},
+	}
+	for _, c := range cases {
+		fn, err := proxyFunc(c.proxy, c.noProxy)
+		if err != nil {
+			t.Fatalf("proxyFunc(%q, %q): %v", c.proxy, c.noProxy, err)
+		}
+		req, _ := http.NewRequest("GET", c.target, nil)
+		u, err := fn(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+		if got != c.want {
+			t.Errorf("proxy=%q no-proxy=%q %s: got %q, want %q", c.proxy, c.noProxy, c.target, got, c.want)
+		}
+	}
+}
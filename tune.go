@@ -0,0 +1,186 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// Qiniu multipart uploads accept at most 10000 parts per object.
+	maxParts        = 10000
+	minAutoBlock    = 4 * 1024 * 1024
+	blockAlign      = 1024 * 1024
+	autoMaxParallel = 16
+	tuneInterval    = 3 * time.Second
+)
+
+// blockSizeFor returns the part size used for a file of the given size. In
+// --auto mode the size grows with the file, otherwise --block is used as-is
+// unless it would exceed the part-count limit.
+func blockSizeFor(size int64) int64 {
+	block := int64(runConfig.blockSize)
+	if runConfig.autoMode {
+		block = minAutoBlock
+	}
+	if need := (size + maxParts - 1) / maxParts; need > block {
+		block = (need + blockAlign - 1) / blockAlign * blockAlign
+	}
+	if runConfig.autoMode && size > 0 && size < block {
+		block = size
+	}
+	return block
+}
+
+func workerCount() int {
+	if runConfig.autoMode && runConfig.parallel < autoMaxParallel {
+		return autoMaxParallel
+	}
+	return runConfig.parallel
+}
+
+// tuner limits how many of the started workers may be active at once. The
+// limit is raised while throughput keeps improving and lowered when it drops
+// or when too many requests fail. Throughput is the number of bytes moved in
+// each tuneInterval window, counted as they are read rather than when a
+// part completes, so that large parts still spanning a window count.
+type tuner struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    int
+	active   int
+	max      int
+	bytes    int64
+	errors   int64
+	parts    int64
+	lastRate float64
+	stop     chan struct{}
+}
+
+// newTuner returns nil outside of --auto mode; a nil tuner never blocks.
+func newTuner() *tuner {
+	if !runConfig.autoMode {
+		return nil
+	}
+	t := &tuner{
+		limit: runConfig.parallel,
+		max:   workerCount(),
+		stop:  make(chan struct{}),
+	}
+	if t.limit < 1 {
+		t.limit = 1
+	}
+	t.cond = sync.NewCond(&t.mu)
+	go t.run()
+	return t
+}
+
+func (t *tuner) acquire() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	for t.active >= t.limit {
+		t.cond.Wait()
+	}
+	t.active++
+	t.mu.Unlock()
+}
+
+func (t *tuner) release(err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.active--
+	if err != nil {
+		t.errors++
+	} else {
+		t.parts++
+	}
+	t.mu.Unlock()
+	t.cond.Signal()
+}
+
+// add counts n bytes moved in the current window.
+func (t *tuner) add(n int64) {
+	if t == nil || n == 0 {
+		return
+	}
+	t.mu.Lock()
+	t.bytes += n
+	t.mu.Unlock()
+}
+
+// tunedReaderAt counts every byte read through it in the tuner window.
+type tunedReaderAt struct {
+	io.ReaderAt
+	tuner *tuner
+}
+
+func (r tunedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.ReaderAt.ReadAt(p, off)
+	r.tuner.add(int64(n))
+	return n, err
+}
+
+// readerAt wraps r so that the bytes read from it count towards the rate.
+func (t *tuner) readerAt(r io.ReaderAt) io.ReaderAt {
+	if t == nil {
+		return r
+	}
+	return tunedReaderAt{ReaderAt: r, tuner: t}
+}
+
+func (t *tuner) close() {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+}
+
+func (t *tuner) run() {
+	ticker := time.NewTicker(tuneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			t.adjust()
+		}
+	}
+}
+
+func (t *tuner) adjust() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	total := t.parts + t.errors
+	if t.bytes == 0 && total == 0 {
+		// nothing moved, e.g. while waiting for the next file; the
+		// window says nothing about the limit.
+		return
+	}
+	rate := float64(t.bytes) / tuneInterval.Seconds()
+	prev := t.limit
+	switch {
+	case total > 0 && float64(t.errors)/float64(total) > 0.2:
+		t.limit /= 2
+	case rate >= t.lastRate*1.05:
+		t.limit++
+	case rate < t.lastRate*0.9:
+		t.limit--
+	}
+	if t.limit < 1 {
+		t.limit = 1
+	}
+	if t.limit > t.max {
+		t.limit = t.max
+	}
+	if t.limit != prev {
+		logs.Debug("auto tuning", "rate", int64(rate), "errors", t.errors, "from", prev, "to", t.limit)
+	}
+	t.lastRate = rate
+	t.bytes, t.errors, t.parts = 0, 0, 0
+	t.cond.Broadcast()
+}
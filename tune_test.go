@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testTuner returns a tuner without its ticker, driven by calling adjust.
+func testTuner(limit, max int) *tuner {
+	t := &tuner{limit: limit, max: max}
+	t.cond = sync.NewCond(&t.mu)
+	return t
+}
+
+// window moves n bytes through t as one part, fails failures parts and
+// then ends the window.
+func window(t *tuner, n int64, failures int) {
+	if n > 0 {
+		t.acquire()
+		t.add(n)
+		t.release(nil)
+	}
+	for i := 0; i < failures; i++ {
+		t.acquire()
+		t.release(errors.New("part failed"))
+	}
+	t.adjust()
+}
+
+func TestTunerGrowth(t *testing.T) {
+	tune := testTuner(2, 4)
+	steps := []struct {
+		bytes int64
+		want  int
+	}{
+		{bytes: 1000, want: 3},
+		{bytes: 2000, want: 4},
+		// capped at max.
+		{bytes: 4000, want: 4},
+		// a steady rate keeps the limit.
+		{bytes: 4000, want: 4},
+		{bytes: 1000, want: 3},
+	}
+	for i, s := range steps {
+		window(tune, s.bytes, 0)
+		if tune.limit != s.want {
+			t.Fatalf("window %d: limit = %d, want %d", i, tune.limit, s.want)
+		}
+	}
+}
+
+func TestTunerBackoff(t *testing.T) {
+	tune := testTuner(8, 8)
+	window(tune, 1000, 3)
+	if tune.limit != 4 {
+		t.Fatalf("limit = %d after failures, want 4", tune.limit)
+	}
+	window(tune, 0, 2)
+	window(tune, 0, 2)
+	window(tune, 0, 2)
+	if tune.limit != 1 {
+		t.Fatalf("limit = %d, want it to stop at 1", tune.limit)
+	}
+}
+
+func TestTunerIdleWindows(t *testing.T) {
+	tune := testTuner(2, 8)
+	window(tune, 1000, 0)
+	if tune.limit != 3 {
+		t.Fatalf("limit = %d, want 3", tune.limit)
+	}
+	for i := 0; i < 3; i++ {
+		window(tune, 0, 0)
+	}
+	if tune.limit != 3 {
+		t.Fatalf("idle windows changed the limit to %d", tune.limit)
+	}
+	// the same rate as before the idle windows is no improvement.
+	window(tune, 1000, 0)
+	if tune.limit != 3 {
+		t.Fatalf("limit = %d after an unchanged rate, want 3", tune.limit)
+	}
+}
+
+func TestTunerCountsPartialReads(t *testing.T) {
+	tune := testTuner(1, 1)
+	r := io.NewSectionReader(tune.readerAt(strings.NewReader(strings.Repeat("x", 10000))), 0, 10000)
+	if _, err := io.CopyN(io.Discard, r, 4000); err != nil {
+		t.Fatal(err)
+	}
+	// the part is still being sent, but its bytes count in this window.
+	if tune.bytes != 4000 {
+		t.Fatalf("counted %d bytes, want 4000", tune.bytes)
+	}
+	var nilTuner *tuner
+	if _, ok := nilTuner.readerAt(strings.NewReader("")).(*strings.Reader); !ok {
+		t.Fatal("a nil tuner wrapped the reader")
+	}
+}
@@ -2,81 +2,101 @@ package main
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
 	"sync"
+	"time"
 
-	"github.com/cheggaaa/pb/v3"
 	cmap "github.com/orcaman/concurrent-map"
 )
 
+// apiBase and uploadBase are prepended to the endpoints below, they are
+// variables so that tests can point them at a local server.
+var (
+	apiBase    = "https://cowtransfer.com"
+	uploadBase = "https://upload.qiniup.com"
+)
+
 const (
-	prepareSend    = "https://cowtransfer.com/api/transfer/v2/preparesend"
-	setPassword    = "https://cowtransfer.com/api/transfer/v2/bindpasscode"
-	beforeUpload   = "https://cowtransfer.com/api/transfer/v2/beforeupload"
-	uploadFinish   = "https://cowtransfer.com/api/transfer/v2/uploaded"
-	uploadComplete = "https://cowtransfer.com/api/transfer/v2/complete"
-	initUpload     = "https://upload.qiniup.com/buckets/cftransfer/objects/%s/uploads"
-	doUpload       = "https://upload.qiniup.com/buckets/cftransfer/objects/%s/uploads/%s/%d"
-	finUpload      = "https://upload.qiniup.com/buckets/cftransfer/objects/%s/uploads/%s"
+	prepareSend    = "/api/transfer/v2/preparesend"
+	setPassword    = "/api/transfer/v2/bindpasscode"
+	beforeUpload   = "/api/transfer/v2/beforeupload"
+	uploadFinish   = "/api/transfer/v2/uploaded"
+	uploadComplete = "/api/transfer/v2/complete"
+	initUpload     = "/buckets/cftransfer/objects/%s/uploads"
+	doUpload       = "/buckets/cftransfer/objects/%s/uploads/%s/%d"
+	finUpload      = "/buckets/cftransfer/objects/%s/uploads/%s"
 
 	// block = 1024 * 1024
 )
 
 type uploadConfig struct {
 	wg      *sync.WaitGroup
+	file    io.ReaderAt
 	config  *initResp
 	hashMap *cmap.ConcurrentMap
+	tuner   *tuner
+	log     *logger
+	failed  *firstError
 }
 
-func upload(files []string) {
+func upload(files []string) error {
+	if runConfig.dryRun {
+		return dryRunUpload(files)
+	}
+	var errs []error
+	total := 0
 	if !runConfig.singleMode {
+		// files are collected first so that the overall progress knows
+		// the size of the whole run.
+		var paths []string
+		var infos []os.FileInfo
 		for _, v := range files {
 			if isExist(v) {
-				err := filepath.Walk(v, func(path string, info os.FileInfo, err error) error {
+				err := walkFiles(v, func(path string, info os.FileInfo, err error) error {
 					if err != nil {
-						fmt.Printf("filapath walker returns error: %v, onfile: %s", err, path)
+						fmt.Printf("filapath walker returns error: %v, onfile: %s\n", err, path)
+						errs = append(errs, err)
 						return nil
 					}
-					if info.IsDir() {
-						return nil
-					}
-					config, err := getSendConfig(info.Size())
-					if err != nil {
-						fmt.Printf("getSendConfig returns error: %v, onfile: %s", err, path)
-						return nil
-					}
-					fmt.Printf("Destination: %s\n", config.UniqueURL)
-					err = _upload(path, config)
-					if err != nil {
-						fmt.Printf("upload returns error: %v, onfile: %s", err, path)
-					}
-					err = completeUpload(config)
-					if err != nil {
-						fmt.Printf("complete upload returns error: %v, onfile: %s", err, path)
-					}
+					total++
+					paths = append(paths, path)
+					infos = append(infos, info)
+					progress.expect(info.Size())
 					return nil
 				})
 				if err != nil {
-					fmt.Printf("filepath.walk returns error: %v, onfile: %s", err, v)
+					fmt.Printf("filepath.walk returns error: %v, onfile: %s\n", err, v)
+					errs = append(errs, err)
 				}
 			} else {
 				fmt.Printf("%s not found\n", v)
+				total++
+				errs = append(errs, errorf(kindUsage, "%s not found", v))
+			}
+		}
+		for i, path := range paths {
+			if err := uploadFile(path, infos[i]); err != nil {
+				errs = append(errs, err)
 			}
 		}
 
-		return
+		if err := report.flush(); err != nil {
+			fmt.Printf("%v\n", err)
+		}
+		return combineErrors(errs, total)
 	}
 	totalSize := int64(0)
 
 	for _, v := range files {
 		if isExist(v) {
-			err := filepath.Walk(v, func(path string, info os.FileInfo, err error) error {
-				if info.IsDir() {
+			err := walkFiles(v, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
 					return nil
 				}
 				totalSize += info.Size()
@@ -87,150 +107,280 @@ func upload(files []string) {
 			}
 		} else {
 			fmt.Printf("%s not found\n", v)
+			total++
+			errs = append(errs, errorf(kindUsage, "%s not found", v))
 		}
 	}
 
+	progress.expect(totalSize)
 	config, err := getSendConfig(totalSize)
 	if err != nil {
 		fmt.Printf("getSendConfig(single mode) returns error: %v\n", err)
+		runHooks("", "", report.entries, err)
+		return err
 	}
 	fmt.Printf("Destination: %s\n", config.UniqueURL)
+	record := newHistoryRecord(config)
 	for _, v := range files {
 		if isExist(v) {
-			err = filepath.Walk(v, func(path string, info os.FileInfo, err error) error {
+			err = walkFiles(v, func(path string, info os.FileInfo, err error) error {
 				if err != nil {
-					fmt.Printf("filapath walker returns error: %v, onfile: %s", err, path)
-					return nil
-				}
-				if info.IsDir() {
+					fmt.Printf("filapath walker returns error: %v, onfile: %s\n", err, path)
+					errs = append(errs, err)
 					return nil
 				}
-				err = _upload(path, config)
+				total++
+				entry := report.add(path, info.Size())
+				entry.Link = config.UniqueURL
+				item, err := _upload(path, config)
+				entry.finish(err)
 				if err != nil {
 					fmt.Printf("upload returns error: %v, onfile: %s\n", err, path)
+					errs = append(errs, err)
+					return nil
 				}
+				record.Files = append(record.Files, *item)
 				return nil
 			})
 			if err != nil {
 				fmt.Printf("filepath.walk(upload) returns error: %v, onfile: %s\n", err, v)
+				errs = append(errs, err)
 			}
-		} else {
-			fmt.Printf("%s not found\n", v)
 		}
 	}
-	err = completeUpload(config)
+	record.Code, err = completeUpload(config)
+	for _, e := range report.entries {
+		e.Code = record.Code
+		if err != nil && e.Error == "" {
+			e.Error = err.Error()
+		}
+	}
+	if ferr := report.flush(); ferr != nil {
+		fmt.Printf("%v\n", ferr)
+	}
+	hookErr := err
+	if hookErr == nil {
+		hookErr = combineErrors(errs, total)
+	}
+	runHooks(config.UniqueURL, record.Code, report.entries, hookErr)
 	if err != nil {
 		fmt.Printf("complete upload(single mode) returns error: %v\n", err)
+		return err
+	}
+	if err = saveHistory(record); err != nil {
+		fmt.Printf("save history returns error: %v\n", err)
 	}
+	return combineErrors(errs, total)
 }
 
-func _upload(v string, baseConf *prepareSendResp) error {
-	fmt.Printf("Local: %s\n", v)
-	if runConfig.debugMode {
-		log.Println("retrieving file info...")
+// uploadFile sends one file as its own transfer, recording it in the
+// report and the history.
+func uploadFile(path string, info os.FileInfo) (err error) {
+	entry := report.add(path, info.Size())
+	defer func() {
+		runHooks(entry.Link, entry.Code, []*reportEntry{entry}, err)
+	}()
+	config, err := getSendConfig(info.Size())
+	if err != nil {
+		fmt.Printf("getSendConfig returns error: %v, onfile: %s\n", err, path)
+		entry.finish(err)
+		return err
 	}
-	info, err := getFileInfo(v)
+	fmt.Printf("Destination: %s\n", config.UniqueURL)
+	entry.Link = config.UniqueURL
+	record := newHistoryRecord(config)
+	item, err := _upload(path, config)
 	if err != nil {
-		return fmt.Errorf("getFileInfo returns error: %v", err)
+		fmt.Printf("upload returns error: %v, onfile: %s\n", err, path)
+		entry.finish(err)
+		return err
 	}
-
-	config, err := getUploadConfig(info, baseConf)
+	record.Files = append(record.Files, *item)
+	record.Code, err = completeUpload(config)
+	entry.Code = record.Code
+	entry.finish(err)
 	if err != nil {
-		return fmt.Errorf("getUploadConfig returns error: %v", err)
+		fmt.Printf("complete upload returns error: %v, onfile: %s\n", err, path)
+		return err
 	}
-	var bar *pb.ProgressBar
-	if !runConfig.silentMode {
-		bar = pb.Full.Start64(info.Size())
-		bar.Set(pb.Bytes, true)
+	if err = saveHistory(record); err != nil {
+		fmt.Printf("save history returns error: %v\n", err)
+	}
+	return nil
+}
+
+func _upload(v string, baseConf *prepareSendResp) (*historyFile, error) {
+	fmt.Printf("Local: %s\n", v)
+	l := logs.With("file", v, "transfer", baseConf.TransferGUID)
+	l.Debug("retrieving file info")
+	info, err := getFileInfo(v)
+	if err != nil {
+		return nil, fmt.Errorf("getFileInfo returns error: %w", err)
 	}
 	file, err := os.Open(v)
 	if err != nil {
-		return fmt.Errorf("openFile returns error: %v", err)
+		return nil, fmt.Errorf("openFile returns error: %w", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	abs, err := filepath.Abs(v)
+	if err != nil {
+		abs = v
+	}
+
+	if runConfig.compress != compressNone {
+		sum, err := uploadCompressed(l, file, info, baseConf)
+		if err != nil {
+			return nil, err
+		}
+		return &historyFile{Path: abs, Size: info.Size(), MD5: sum}, nil
+	}
+	if splitBytes > 0 && info.Size() > splitBytes {
+		sum, err := uploadVolumes(l, file, info, baseConf)
+		if err != nil {
+			return nil, err
+		}
+		return &historyFile{Path: abs, Size: info.Size(), MD5: sum}, nil
+	}
+
+	// the whole-file digest is only kept for the history record, so it is
+	// computed alongside the part uploads.
+	digest := make(chan string, 1)
+	go func() {
+		hash := md5.New()
+		_, _ = io.Copy(hash, io.NewSectionReader(file, 0, info.Size()))
+		digest <- fmt.Sprintf("%x", hash.Sum(nil))
+	}()
+
+	if err := uploadSection(l, file, info, baseConf); err != nil {
+		return nil, err
+	}
+	return &historyFile{
+		Path: abs,
+		Size: info.Size(),
+		MD5:  <-digest,
+	}, nil
+}
+
+// uploadSection uploads the content of r as one remote file named and sized
+// after info.
+func uploadSection(l *logger, r io.ReaderAt, info os.FileInfo, baseConf *prepareSendResp) error {
+	config, err := getUploadConfig(l, info, baseConf)
+	if err != nil {
+		return fmt.Errorf("getUploadConfig returns error: %w", err)
 	}
+	bar := progress.start(info.Name(), info.Size())
 
 	wg := new(sync.WaitGroup)
 	ch := make(chan *uploadPart)
 	hashMap := cmap.New()
-	for i := 0; i < runConfig.parallel; i++ {
+	failed := new(firstError)
+	tune := newTuner()
+	defer tune.close()
+	for i := 0; i < workerCount(); i++ {
 		//go uploader(&ch, wg, bar, config.UploadToken, &hashMap)
 		go uploader(&ch, uploadConfig{
 			wg:      wg,
+			file:    r,
 			config:  config,
 			hashMap: &hashMap,
+			tuner:   tune,
+			log:     l,
+			failed:  failed,
 		})
 	}
 	part := int64(0)
-	for {
+	block := blockSizeFor(info.Size())
+	progress.setParts(bar, (info.Size()+block-1)/block)
+	l.Debug("upload started", "size", info.Size(), "block", block, "workers", workerCount())
+	for offset := int64(0); offset < info.Size() && failed.get() == nil; offset += block {
 		part++
-		buf := make([]byte, runConfig.blockSize)
-		nr, err := file.Read(buf)
-		if nr <= 0 || err != nil {
-			break
+		size := block
+		if offset+size > info.Size() {
+			size = info.Size() - offset
 		}
-		if nr > 0 {
-			wg.Add(1)
-			ch <- &uploadPart{
-				bar:     bar,
-				content: buf[:nr],
-				count:   part,
-			}
+		wg.Add(1)
+		ch <- &uploadPart{
+			bar:    bar,
+			offset: offset,
+			size:   size,
+			count:  part,
 		}
 	}
 
 	wg.Wait()
 	close(ch)
-	_ = file.Close()
-	if !runConfig.silentMode && bar != nil {
-		bar.Finish()
+	progress.finish(bar)
+	if err := failed.get(); err != nil {
+		return err
 	}
 	// finish upload
-	err = finishUpload(config, info, &hashMap, part)
+	err = finishUpload(l, config, info, &hashMap, part)
 	if err != nil {
-		return fmt.Errorf("finishUpload returns error: %v", err)
+		return fmt.Errorf("finishUpload returns error: %w", err)
 	}
 	return nil
 }
 
+// uploader reads each part straight from the file through its own
+// io.SectionReader, so a failed part can be re-read and retried without
+// holding a copy of it in memory. A part is tried up to maxRetries times;
+// after that its error is recorded in conf.failed and the parts still queued
+// are skipped.
 func uploader(ch *chan *uploadPart, conf uploadConfig) {
 	for item := range *ch {
-	Start:
-		postURL := fmt.Sprintf(doUpload, conf.config.EncodeID, conf.config.ID, item.count)
-		if runConfig.debugMode {
-			log.Printf("part %d start uploading, size: %d", item.count, len(item.content))
-			log.Printf("part %d posting %s", item.count, postURL)
-		}
+		postURL := fmt.Sprintf(uploadBase+doUpload, conf.config.EncodeID, conf.config.ID, item.count)
+		l := conf.log.With("part", item.count)
+		l.Debug("part start uploading", "size", item.size, "endpoint", postURL)
 
 		//blockPut
-		ticket, err := blockPut(postURL, item.content, conf.config.Token)
-		if err != nil {
-			if runConfig.debugMode {
-				log.Printf("part %d failed. error: %s", item.count, err)
+		src := conf.file
+		if item.data != nil {
+			src = bytes.NewReader(item.data)
+		}
+		src = conf.tuner.readerAt(src)
+		var ticket string
+		var err error
+		for retry := 0; retry < maxRetries && conf.failed.get() == nil; retry++ {
+			if retry > 0 {
+				l.Debug("part failed (retrying)", "error", err)
+				time.Sleep(retryDelay(retry))
+			}
+			conf.tuner.acquire()
+			progress.partStart(item.bar)
+			ticket, err = blockPut(l, postURL, io.NewSectionReader(src, item.offset, item.size), conf.config.Token)
+			progress.partEnd(item.bar, err)
+			conf.tuner.release(err)
+			if err == nil || !retryable(err) {
+				break
 			}
-			goto Start
 		}
-		if !runConfig.silentMode && item.bar != nil {
-			item.bar.Add(len(item.content))
+		if err != nil {
+			l.Warn("part failed", "error", err)
+			conf.failed.set(wrapError(kindNetwork, fmt.Errorf("part %d returns error: %w", item.count, err)))
+		} else if ticket != "" {
+			if !runConfig.silentMode && item.bar != nil {
+				item.bar.Add64(item.size)
+			}
+			l.Debug("part finished")
+			conf.hashMap.Set(strconv.FormatInt(item.count, 10), ticket)
 		}
-
-		if runConfig.debugMode {
-			log.Printf("part %d finished.", item.count)
+		if item.release != nil {
+			item.release()
 		}
-		conf.hashMap.Set(strconv.FormatInt(item.count, 10), ticket)
 		conf.wg.Done()
 	}
 
 }
 
-func finishUpload(config *initResp, info os.FileInfo, hashMap *cmap.ConcurrentMap, limit int64) error {
-	if runConfig.debugMode {
-		log.Println("finishing upload...")
-		log.Println("step1 -> api/mergeFile")
-	}
+func finishUpload(l *logger, config *initResp, info os.FileInfo, hashMap *cmap.ConcurrentMap, limit int64) error {
+	l.Debug("step1 -> api/mergeFile")
 	// filename := urlSafeEncode(info.Name())
 	// var fileLocate string
 	// fileLocate = urlSafeEncode(fmt.Sprintf("%s/%s/%s", config.Prefix, config.TransferGUID, info.Name()))
 	// mergeFileURL := fmt.Sprintf(uploadMergeFile, strconv.FormatInt(info.Size(), 10), fileLocate, filename)
-	mergeFileURL := fmt.Sprintf(finUpload, config.EncodeID, config.ID)
+	mergeFileURL := fmt.Sprintf(uploadBase+finUpload, config.EncodeID, config.ID)
 	var postData clds
 	for i := int64(1); i <= limit; i++ {
 		item, alimasu := hashMap.Get(strconv.FormatInt(i, 10))
@@ -246,9 +396,7 @@ func finishUpload(config *initResp, info os.FileInfo, hashMap *cmap.ConcurrentMa
 	if err != nil {
 		return err
 	}
-	if runConfig.debugMode {
-		log.Printf("merge payload: %s\n", postBody)
-	}
+	l.Debug("merge payload", "payload", postBody)
 	reader := bytes.NewReader(postBody)
 	resp, err := newRequest(mergeFileURL, reader, config.Token, "POST")
 	if err != nil {
@@ -261,15 +409,13 @@ func finishUpload(config *initResp, info os.FileInfo, hashMap *cmap.ConcurrentMa
 		return err
 	}
 
-	if runConfig.debugMode {
-		log.Println("step2 -> api/uploaded")
-	}
+	l.Debug("step2 -> api/uploaded")
 	data := map[string]string{
 		"transferGuid": config.TransferGUID,
 		"fileGuid":     config.FileGUID,
 		"hash":         mergeResp.Hash,
 	}
-	body, err := newMultipartRequest(uploadFinish, data, 0)
+	body, err := newMultipartRequest(apiBase+uploadFinish, data, 0)
 	if err != nil {
 		return err
 	}
@@ -279,24 +425,32 @@ func finishUpload(config *initResp, info os.FileInfo, hashMap *cmap.ConcurrentMa
 	return nil
 }
 
-func completeUpload(config *prepareSendResp) error {
+func completeUpload(config *prepareSendResp) (string, error) {
 	data := map[string]string{"transferGuid": config.TransferGUID, "fileId": ""}
-	if runConfig.debugMode {
-		log.Println("step3 -> api/completeUpload")
-	}
-	body, err := newMultipartRequest(uploadComplete, data, 0)
+	logs.Debug("step3 -> api/completeUpload", "transfer", config.TransferGUID)
+	body, err := newMultipartRequest(apiBase+uploadComplete, data, 0)
 	if err != nil {
-		return err
+		return "", err
 	}
 	var rBody finishResponse
 	if err := json.Unmarshal(body, &rBody); err != nil {
-		return fmt.Errorf("read finish resp failed: %s", err)
+		return "", fmt.Errorf("read finish resp failed: %s", err)
 	}
 	if !rBody.Status {
-		return fmt.Errorf("finish upload failed: complete is not true")
+		return "", errorf(kindGeneral, "finish upload failed: complete is not true")
 	}
 	fmt.Printf("Short Download Code: %s\n", rBody.TempDownloadCode)
-	return nil
+	showQRCode(config.UniqueURL)
+	return rBody.TempDownloadCode, nil
+}
+
+func newHistoryRecord(config *prepareSendResp) *historyRecord {
+	return &historyRecord{
+		Time:        time.Now(),
+		Link:        config.UniqueURL,
+		HasPassword: runConfig.passCode != "",
+		ValidDays:   runConfig.validDays,
+	}
 }
 
 func getSendConfig(totalSize int64) (*prepareSendResp, error) {
@@ -304,7 +458,7 @@ func getSendConfig(totalSize int64) (*prepareSendResp, error) {
 		"validDays": strconv.Itoa(runConfig.validDays),
 		"totalSize": strconv.FormatInt(totalSize, 10),
 	}
-	body, err := newMultipartRequest(prepareSend, data, 0)
+	body, err := newMultipartRequest(apiBase+prepareSend, data, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -314,7 +468,7 @@ func getSendConfig(totalSize int64) (*prepareSendResp, error) {
 		return nil, err
 	}
 	if config.Error {
-		return nil, fmt.Errorf(config.ErrorMessage)
+		return nil, apiError(config.ErrorMessage)
 	}
 	if runConfig.passCode != "" {
 		// set password
@@ -322,23 +476,19 @@ func getSendConfig(totalSize int64) (*prepareSendResp, error) {
 			"transferguid": config.TransferGUID,
 			"passcode":     runConfig.passCode,
 		}
-		body, err = newMultipartRequest(setPassword, data, 0)
+		body, err = newMultipartRequest(apiBase+setPassword, data, 0)
 		if err != nil {
 			return nil, err
 		}
 		if string(body) != "true" {
-			return nil, fmt.Errorf("set password unsuccessful")
+			return nil, errorf(kindAuth, "set password unsuccessful")
 		}
 	}
 	return config, nil
 }
 
-func getUploadConfig(info os.FileInfo, config *prepareSendResp) (*initResp, error) {
-
-	if runConfig.debugMode {
-		log.Println("retrieving upload config...")
-		log.Println("step 2/2 -> beforeUpload")
-	}
+func getUploadConfig(l *logger, info os.FileInfo, config *prepareSendResp) (*initResp, error) {
+	l.Debug("step 2/2 -> beforeUpload")
 
 	data := map[string]string{
 		"fileId":        "",
@@ -349,7 +499,7 @@ func getUploadConfig(info os.FileInfo, config *prepareSendResp) (*initResp, erro
 		"transferGuid":  config.TransferGUID,
 		"storagePrefix": config.Prefix,
 	}
-	resp, err := newMultipartRequest(beforeUpload, data, 0)
+	resp, err := newMultipartRequest(apiBase+beforeUpload, data, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -368,7 +518,7 @@ func getUploadConfig(info os.FileInfo, config *prepareSendResp) (*initResp, erro
 		return nil, err
 	}
 	w := urlSafeEncode(fmt.Sprintf("%s/%s/%s", config.Prefix, config.TransferGUID, info.Name()))
-	inits := fmt.Sprintf(initUpload, w)
+	inits := fmt.Sprintf(uploadBase+initUpload, w)
 	resp, err = newRequest(inits, bytes.NewReader(p), config.UploadToken, "POST")
 	if err != nil {
 		return nil, err
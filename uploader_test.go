@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// partServer accepts part uploads, answering with the MD5 of the body the
+// way the upload endpoint does.
+func partServer(tb testing.TB) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := md5.New()
+		if _, err := io.Copy(h, r.Body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		sum := fmt.Sprintf("%x", h.Sum(nil))
+		_ = json.NewEncoder(w).Encode(upResp{Etag: sum, MD5: sum})
+	}))
+	tb.Cleanup(srv.Close)
+	return srv
+}
+
+// BenchmarkUploadBlock measures one part upload. "section" is the current
+// path, streaming the part from the file through an io.SectionReader;
+// "buffered" copies the part into a fresh block buffer first, as parts were
+// before. Run with -benchmem: allocations per op of the section path do not
+// grow with the block size.
+func BenchmarkUploadBlock(b *testing.B) {
+	srv := partServer(b)
+	saved := runConfig.hashCheck
+	runConfig.hashCheck = true
+	defer func() { runConfig.hashCheck = saved }()
+
+	for _, size := range []int64{1 << 20, 4 << 20} {
+		path := filepath.Join(b.TempDir(), "block")
+		if err := os.WriteFile(path, bytes.Repeat([]byte{'x'}, int(size)), 0644); err != nil {
+			b.Fatal(err)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer file.Close()
+
+		b.Run(fmt.Sprintf("section/%dMiB", size>>20), func(b *testing.B) {
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := blockPut(logs, srv.URL, io.NewSectionReader(file, 0, size), "token"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("buffered/%dMiB", size>>20), func(b *testing.B) {
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buf := make([]byte, size)
+				if _, err := file.ReadAt(buf, 0); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := blockPut(logs, srv.URL, io.NewSectionReader(bytes.NewReader(buf), 0, size), "token"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// peakHeap runs fn and returns the highest heap use seen above the heap in
+// use before it started, sampled every millisecond.
+func peakHeap(fn func()) uint64 {
+	var ms runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+	base := ms.HeapInuse
+
+	stop, peak := make(chan struct{}), make(chan uint64)
+	go func() {
+		var ms runtime.MemStats
+		max := base
+		tick := time.NewTicker(time.Millisecond)
+		defer tick.Stop()
+		for {
+			runtime.ReadMemStats(&ms)
+			if ms.HeapInuse > max {
+				max = ms.HeapInuse
+			}
+			select {
+			case <-stop:
+				peak <- max - base
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+	fn()
+	close(stop)
+	return <-peak
+}
+
+// BenchmarkUploadSection uploads a whole file through uploadSection to the
+// fake server with several --parallel values and reports the peak heap.
+// Parts are streamed from the file, so the peak stays below parallel times
+// the block size, and the benchmark fails if it does not.
+func BenchmarkUploadSection(b *testing.B) {
+	const block = 8 << 20
+	fake, _ := withFakeCowtransfer(b)
+	fake.discard = true
+	runConfig.blockSize = block
+	runConfig.silentMode = true
+
+	path := filepath.Join(b.TempDir(), "section")
+	if err := os.WriteFile(path, bytes.Repeat([]byte{'x'}, 8*block), 0644); err != nil {
+		b.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		b.Fatal(err)
+	}
+	base := &prepareSendResp{UploadToken: "uptoken", TransferGUID: "transfer", Prefix: "prefix"}
+
+	for _, parallel := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("parallel=%d", parallel), func(b *testing.B) {
+			runConfig.parallel = parallel
+			b.SetBytes(info.Size())
+			var peak uint64
+			for i := 0; i < b.N; i++ {
+				p := peakHeap(func() {
+					if err := uploadSection(logs, file, info, base); err != nil {
+						b.Fatal(err)
+					}
+				})
+				if p > peak {
+					peak = p
+				}
+			}
+			b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MiB")
+			if limit := uint64(parallel) * block; peak > limit {
+				b.Errorf("peak heap %d bytes above parallel x block size (%d bytes)", peak, limit)
+			}
+		})
+	}
+}
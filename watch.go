@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type watchEvent struct {
+	path string
+	// closed is set when the writer is known to be done with the file
+	// (close-write or rename into the directory).
+	closed bool
+	// rescan marks events reported by a full rescan after the kernel
+	// dropped events; files already seen unchanged are ignored.
+	rescan bool
+}
+
+type pendingFile struct {
+	size   int64
+	mod    time.Time
+	since  time.Time
+	closed bool
+	// attempts and retryAt are set for files whose upload failed.
+	attempts int
+	retryAt  time.Time
+}
+
+type watchJob struct {
+	path     string
+	info     os.FileInfo
+	attempts int
+	err      error
+}
+
+// maxWatchBackoff caps the delay before a failed upload is tried again.
+const maxWatchBackoff = 5 * time.Minute
+
+func watchBackoff(attempts int) time.Duration {
+	if attempts > 8 {
+		return maxWatchBackoff
+	}
+	d := time.Duration(1<<uint(attempts)) * time.Second
+	if d > maxWatchBackoff {
+		return maxWatchBackoff
+	}
+	return d
+}
+
+// runWatch uploads every new file that appears in dir once it stopped
+// changing for --settle seconds, until interrupted. Uploads run one at a
+// time on a worker goroutine so that the event loop keeps draining the
+// watcher; failed uploads are queued again with an increasing delay.
+func runWatch(args []string) error {
+	if len(args) != 1 {
+		return errorf(kindUsage, "usage: watch <dir>")
+	}
+	dir := filepath.Clean(args[0])
+	if !isExist(dir) || !isDir(dir) {
+		return errorf(kindUsage, "%s is not a directory", dir)
+	}
+	if runConfig.moveTo != "" && !isDir(runConfig.moveTo) {
+		return errorf(kindUsage, "%s is not a directory", runConfig.moveTo)
+	}
+	filter, err := newWalkFilter(dir)
+	if err != nil {
+		return err
+	}
+	settle := time.Duration(runConfig.settle) * time.Second
+
+	// seen holds the modification time of files that were present at
+	// start or already uploaded, for telling them apart after a rescan.
+	seen := make(map[string]time.Time)
+	if entries, err := os.ReadDir(dir); err == nil {
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil {
+				seen[filepath.Join(dir, entry.Name())] = info.ModTime()
+			}
+		}
+	}
+
+	events := make(chan watchEvent, 128)
+	failed := make(chan error, 1)
+	go func() {
+		failed <- watchDir(dir, events)
+	}()
+	// the worker stops through ctx, also when it is still uploading after
+	// a second interrupt and nobody waits for its result anymore.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	jobs := make(chan watchJob)
+	results := make(chan watchJob)
+	go func() {
+		for {
+			var job watchJob
+			select {
+			case <-ctx.Done():
+				return
+			case job = <-jobs:
+			}
+			job.err = watchUpload(job.path, job.info)
+			select {
+			case <-ctx.Done():
+				return
+			case results <- job:
+			}
+		}
+	}()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	fmt.Printf("Watching %s, press Ctrl+C to stop\n", dir)
+	pending := make(map[string]*pendingFile)
+	var queue []watchJob
+	busy := false
+	for {
+		// the next queued job is only offered while the worker is idle.
+		var send chan<- watchJob
+		var next watchJob
+		if len(queue) > 0 && !busy {
+			send, next = jobs, queue[0]
+		}
+		select {
+		case ev := <-events:
+			name := filepath.Base(ev.path)
+			if name == ignoreFile || runConfig.skipHidden && name[0] == '.' || ownOutput(ev.path) {
+				continue
+			}
+			if skip, err := filter.skip(ev.path, false); skip || err != nil {
+				if err != nil {
+					fmt.Printf("%v\n", err)
+				}
+				continue
+			}
+			if ev.rescan {
+				info, err := os.Stat(ev.path)
+				if err != nil || seen[ev.path].Equal(info.ModTime()) {
+					continue
+				}
+			}
+			p, ok := pending[ev.path]
+			if !ok {
+				p = &pendingFile{size: -1}
+				pending[ev.path] = p
+			}
+			p.closed = p.closed || ev.closed
+		case send <- next:
+			queue = queue[1:]
+			busy = true
+		case job := <-results:
+			busy = false
+			if job.err == nil {
+				seen[job.path] = job.info.ModTime()
+				continue
+			}
+			job.attempts++
+			delay := watchBackoff(job.attempts)
+			fmt.Printf("upload of %s failed, retrying in %s: %v\n", job.path, delay, job.err)
+			if _, ok := pending[job.path]; !ok {
+				pending[job.path] = &pendingFile{
+					size:     job.info.Size(),
+					mod:      job.info.ModTime(),
+					closed:   true,
+					attempts: job.attempts,
+					retryAt:  time.Now().Add(delay),
+				}
+			}
+		case now := <-ticker.C:
+			for path, p := range pending {
+				if now.Before(p.retryAt) {
+					continue
+				}
+				info, err := os.Stat(path)
+				if err != nil || !info.Mode().IsRegular() {
+					delete(pending, path)
+					continue
+				}
+				if info.Size() != p.size || !info.ModTime().Equal(p.mod) {
+					p.size, p.mod, p.since = info.Size(), info.ModTime(), now
+					continue
+				}
+				if !p.closed && now.Sub(p.since) < settle {
+					continue
+				}
+				delete(pending, path)
+				if !queued(queue, path) {
+					queue = append(queue, watchJob{path: path, info: info, attempts: p.attempts})
+				}
+			}
+		case err := <-failed:
+			return wrapError(kindGeneral, err)
+		case <-sig:
+			fmt.Printf("Stop watching %s\n", dir)
+			if busy {
+				fmt.Printf("Waiting for the running upload, press Ctrl+C again to abort\n")
+				select {
+				case <-results:
+				case <-sig:
+				}
+			}
+			return report.flush()
+		}
+	}
+}
+
+// ownOutput reports whether path is written by this program while it
+// watches: the --report file, the history database, the --qr-file images
+// and the --report-sidecar files. Uploading those would trigger new writes
+// and so new uploads without end.
+func ownOutput(path string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	if runConfig.reportSidecar && strings.HasSuffix(abs, ".cowtransfer.json") {
+		return true
+	}
+	outputs := []string{runConfig.report}
+	if !runConfig.noHistory {
+		outputs = append(outputs, historyPath())
+	}
+	for _, out := range outputs {
+		if out == "" {
+			continue
+		}
+		if out, err = filepath.Abs(out); err == nil && out == abs {
+			return true
+		}
+	}
+	if runConfig.qrFile == "" {
+		return false
+	}
+	qr, err := filepath.Abs(runConfig.qrFile)
+	if err != nil || filepath.Dir(qr) != filepath.Dir(abs) {
+		return false
+	}
+	// nextQRFile numbers the images of later transfers qr-2.png, qr-3.png...
+	name, ext := filepath.Base(abs), filepath.Ext(qr)
+	if name == filepath.Base(qr) {
+		return true
+	}
+	n := strings.TrimPrefix(name, strings.TrimSuffix(filepath.Base(qr), ext)+"-")
+	if n == name || !strings.HasSuffix(n, ext) {
+		return false
+	}
+	n = strings.TrimSuffix(n, ext)
+	return n != "" && strings.Trim(n, "0123456789") == ""
+}
+
+func queued(queue []watchJob, path string) bool {
+	for _, job := range queue {
+		if job.path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func watchUpload(path string, info os.FileInfo) error {
+	logs.Info("uploading stable file", "path", path, "size", info.Size())
+	if err := uploadFile(path, info); err != nil {
+		return err
+	}
+	if runConfig.report != "" {
+		report.mu.Lock()
+		err := writeReport(runConfig.report, report.entries)
+		report.mu.Unlock()
+		if err != nil {
+			fmt.Printf("%v\n", err)
+		}
+	}
+	switch {
+	case runConfig.moveTo != "":
+		target := filepath.Join(runConfig.moveTo, filepath.Base(path))
+		if err := os.Rename(path, target); err != nil {
+			logs.Warn("move uploaded file failed", "path", path, "error", err)
+		}
+	case runConfig.deleteAfter:
+		if err := os.Remove(path); err != nil {
+			logs.Warn("delete uploaded file failed", "path", path, "error", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchDir reports files created, written or moved into dir using inotify.
+// When the kernel queue overflows and events were lost, every file in dir
+// is reported again as a rescan.
+func watchDir(dir string, events chan<- watchEvent) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("inotify init returns error: %v", err)
+	}
+	defer func() {
+		_ = unix.Close(fd)
+	}()
+	mask := uint32(unix.IN_CREATE | unix.IN_MODIFY | unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO)
+	if _, err = unix.InotifyAddWatch(fd, dir, mask); err != nil {
+		return fmt.Errorf("inotify watch returns error: %v", err)
+	}
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := unix.Read(fd, buf)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("inotify read returns error: %v", err)
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + unix.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[start:start+int(raw.Len)], "\x00"))
+			offset = start + int(raw.Len)
+			if raw.Mask&unix.IN_Q_OVERFLOW != 0 {
+				logs.Warn("inotify queue overflowed, rescanning", "dir", dir)
+				if err := rescanDir(dir, events); err != nil {
+					return fmt.Errorf("rescan returns error: %v", err)
+				}
+				continue
+			}
+			if name == "" || raw.Mask&unix.IN_ISDIR != 0 {
+				continue
+			}
+			events <- watchEvent{
+				path:   filepath.Join(dir, name),
+				closed: raw.Mask&(unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO) != 0,
+			}
+		}
+	}
+}
+
+func rescanDir(dir string, events chan<- watchEvent) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			events <- watchEvent{path: filepath.Join(dir, entry.Name()), rescan: true}
+		}
+	}
+	return nil
+}
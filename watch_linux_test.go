@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWatchRetriesFailedUpload(t *testing.T) {
+	fake, _ := withFakeCowtransfer(t)
+	fake.partCode = http.StatusUnauthorized
+	dir := t.TempDir()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- runWatch([]string{dir})
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if err := os.WriteFile(filepath.Join(dir, "new.txt"), []byte("watched"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wait := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			fake.mu.Lock()
+			ok := cond()
+			fake.mu.Unlock()
+			if ok {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for %s", what)
+	}
+	wait("the failed upload", func() bool {
+		if len(fake.events) == 1 && fake.events[0].Status == "failed" {
+			// let the retry succeed.
+			fake.partCode = 0
+			return true
+		}
+		return false
+	})
+	wait("the retried upload", func() bool {
+		return len(fake.events) == 2 && fake.events[1].Status == "success"
+	})
+
+	_ = syscall.Kill(os.Getpid(), syscall.SIGINT)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("runWatch: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("runWatch did not stop on SIGINT")
+	}
+}
+
+func TestWatchIgnoresOwnOutput(t *testing.T) {
+	fake, _ := withFakeCowtransfer(t)
+	dir := t.TempDir()
+	runConfig.report = filepath.Join(dir, "report.json")
+	runConfig.historyDB = filepath.Join(dir, "history.db")
+	runConfig.qrFile = filepath.Join(dir, "qr.png")
+	runConfig.reportSidecar = true
+
+	done := make(chan error, 1)
+	go func() {
+		done <- runWatch([]string{dir})
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if err := os.WriteFile(filepath.Join(dir, "new.txt"), []byte("watched"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		fake.mu.Lock()
+		n := len(fake.events)
+		fake.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the upload")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	// give the written report, history, QR code and sidecar time to settle
+	// and be picked up if they were not ignored.
+	time.Sleep(3 * time.Second)
+
+	_ = syscall.Kill(os.Getpid(), syscall.SIGINT)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("runWatch: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("runWatch did not stop on SIGINT")
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.names) != 1 || fake.names[0] != "new.txt" {
+		t.Fatalf("uploaded %q, want only new.txt", fake.names)
+	}
+	for _, name := range []string{"report.json", "history.db", "qr.png", "new.txt.cowtransfer.json"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s not written: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// watchDir polls dir for new or changed files where inotify is unavailable.
+func watchDir(dir string, events chan<- watchEvent) error {
+	seen := make(map[string]time.Time)
+	scan := func(report bool) error {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			if mod, ok := seen[path]; !ok || !mod.Equal(info.ModTime()) {
+				seen[path] = info.ModTime()
+				if report {
+					events <- watchEvent{path: path}
+				}
+			}
+		}
+		return nil
+	}
+	if err := scan(false); err != nil {
+		return err
+	}
+	for range time.Tick(2 * time.Second) {
+		if err := scan(true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
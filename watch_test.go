@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestOwnOutput(t *testing.T) {
+	saved := *runConfig
+	defer func() { *runConfig = saved }()
+	dir := t.TempDir()
+	runConfig.report = filepath.Join(dir, "report.json")
+	runConfig.historyDB = filepath.Join(dir, "history.db")
+	runConfig.qrFile = filepath.Join(dir, "qr.png")
+	runConfig.reportSidecar = true
+
+	cases := map[string]bool{
+		"report.json":                true,
+		"history.db":                 true,
+		"qr.png":                     true,
+		"qr-2.png":                   true,
+		"qr-12.png":                  true,
+		"data.bin.cowtransfer.json":  true,
+		"data.bin":                   false,
+		"report.json.bak":            false,
+		"qr-.png":                    false,
+		"qr-x.png":                   false,
+		"qr-2.jpg":                   false,
+		"other.json":                 false,
+		"sub/report.json":            false,
+		"history.db.cowtransfer.txt": false,
+	}
+	for name, want := range cases {
+		if got := ownOutput(filepath.Join(dir, filepath.FromSlash(name))); got != want {
+			t.Errorf("ownOutput(%q) = %v, want %v", name, got, want)
+		}
+	}
+
+	runConfig.noHistory, runConfig.reportSidecar = true, false
+	for _, name := range []string{"history.db", "data.bin.cowtransfer.json"} {
+		if ownOutput(filepath.Join(dir, name)) {
+			t.Errorf("ownOutput(%q) = true with the output disabled", name)
+		}
+	}
+}